@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/chrisvdg/nbdserver/nbd"
 	"github.com/chrisvdg/nbdserver/nbd/backend"
@@ -13,78 +16,115 @@ import (
 
 const (
 	listenAddress = ":7777"
-	exportName    = "default"
-	totalSize     = 1024 * 1024 * 1024
+	// oldstyleListenAddress serves the default export to oldstyle clients
+	oldstyleListenAddress = ":7778"
+	exportName            = "default"
+	totalSize             = 1024 * 1024 * 1024
+	// volumePath is the directory holding the data of the default export,
+	// it is created on the first start and reopened afterwards
+	volumePath = "nbd-volume"
+	// scratchExportName is a throwaway export kept in memory,
+	// its data is lost when the server stops.
+	// It is only served when scratchExportEnv is set to 1.
+	scratchExportName = "scratch"
+	scratchExportEnv  = "NBD_SCRATCH_EXPORT"
+	scratchMaxMemory  = 256 * 1024 * 1024
+	// shutdownTimeout is the time connections get to finish their requests
+	// when the server is interrupted
+	shutdownTimeout = 30 * time.Second
 )
 
 func main() {
-	// create backend
-	files, err := generateFiles(totalSize)
+	// create or reopen the backend
+	volume, err := backend.OpenMultiFileDir(volumePath, backend.Descriptor{
+		Size:     totalSize,
+		Files:    totalSize / backend.DefaultChunkSize,
+		Geometry: backend.DefaultGeometry(),
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// capture interrupt
+	exports := nbd.NewRegistry()
+	err = exports.Add(&nbd.Export{
+		Name:    exportName,
+		Backend: volume,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if os.Getenv(scratchExportEnv) == "1" {
+		scratch := backend.NewMemory(totalSize)
+		scratch.MaxMemory = scratchMaxMemory
+		err = exports.Add(&nbd.Export{
+			Name:    scratchExportName,
+			Backend: scratch,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	server := nbd.NewServer(exports)
+
+	// shut down gracefully on interrupt or when stopped by systemd
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	shutdown := make(chan struct{})
 	go func() {
 		<-c
-		// cleanup files
-		cleanupFiles(files)
-		os.Exit(1)
+		fmt.Println("Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		err := server.Shutdown(ctx)
+		if err != nil {
+			log.Printf("Something went wrong shutting down: %s\n", err)
+		}
+		close(shutdown)
 	}()
 
-	backend := backend.NewMultiFile(files, uint64(totalSize))
-
-	// start server
-	server := nbd.NewServer(backend)
-	fmt.Printf("NBD server listening on: `%s`\n", listenAddress)
-	err = server.ListenAndServe(listenAddress)
+	// listen on the sockets passed by systemd or on the default address
+	listeners, err := nbd.SystemdListeners()
 	if err != nil {
 		log.Fatal(err)
 	}
-}
-
-// generateFiles generates temporary backend files
-// returns a list of those files, the total memory and error
-func generateFiles(size int) ([]*os.File, error) {
-	var files []*os.File
-
-	done := false
-	sizeLeft := size
-	for !done {
-		fSize := sizeLeft
-
-		// detect last iteration
-		if sizeLeft < backend.MaxSingleFileSize {
-			done = true
-		} else {
-			fSize = backend.MaxSingleFileSize
-		}
-
-		file, err := ioutil.TempFile(os.TempDir(), "nbd-file")
+	var oldstyleListener net.Listener
+	if len(listeners) == 0 {
+		l, err := net.Listen("tcp", listenAddress)
 		if err != nil {
-			cleanupFiles(files)
-			return nil, err
+			log.Fatal(err)
 		}
-		// give files their size
-		_, err = file.Write(make([]byte, fSize))
+		listeners = append(listeners, l)
+
+		// legacy clients that only speak oldstyle get the default export
+		oldstyleListener, err = net.Listen("tcp", oldstyleListenAddress)
 		if err != nil {
-			cleanupFiles(files)
-			return nil, err
+			log.Fatal(err)
 		}
-
-		files = append(files, file)
-
-		sizeLeft = sizeLeft - fSize
 	}
 
-	return files, nil
-}
-
-func cleanupFiles(files []*os.File) {
-	for _, f := range files {
-		f.Close()
-		os.Remove(f.Name())
+	// start server
+	served := make(chan error, len(listeners)+1)
+	for _, l := range listeners {
+		fmt.Printf("NBD server listening on: `%s`\n", l.Addr())
+		go func(l net.Listener) {
+			served <- server.Serve(l)
+		}(l)
+	}
+	serving := len(listeners)
+	if oldstyleListener != nil {
+		fmt.Printf("NBD server listening for oldstyle clients on: `%s`\n", oldstyleListener.Addr())
+		go func() {
+			served <- server.ServeOldstyle(oldstyleListener, exportName)
+		}()
+		serving++
 	}
+	for i := 0; i < serving; i++ {
+		err = <-served
+		if err != nbd.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}
+
+	<-shutdown
 }
@@ -0,0 +1,124 @@
+package nbd
+
+import (
+	"crypto/tls"
+	"sync"
+
+	"github.com/chrisvdg/nbdserver/nbd/backend"
+)
+
+// Access defines what an identity is allowed to do with an export
+type Access int
+
+const (
+	// AccessDenied hides the export and refuses to open it
+	AccessDenied Access = iota
+	// AccessReadOnly serves the export as if it were read-only
+	AccessReadOnly
+	// AccessReadWrite serves the export as configured
+	AccessReadWrite
+)
+
+// AllExports can be used as export name in an ACL rule
+// to define the access of an identity to every export
+// that has no rule of its own
+const AllExports = "*"
+
+// NewACL returns an empty ACL, which denies access to every export
+func NewACL() *ACL {
+	return &ACL{
+		rules: make(map[string]map[string]Access),
+	}
+}
+
+// ACL maps client identities to the access they have to exports.
+// Clients that did not authenticate have the empty identity.
+type ACL struct {
+	mu    sync.RWMutex
+	rules map[string]map[string]Access
+}
+
+// Grant sets the access of an identity to the export with the given name
+func (a *ACL) Grant(identity, export string, access Access) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	rules, ok := a.rules[identity]
+	if !ok {
+		rules = make(map[string]Access)
+		a.rules[identity] = rules
+	}
+	rules[export] = access
+}
+
+// Revoke removes the rule of an identity for the export with the given name
+func (a *ACL) Revoke(identity, export string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	rules, ok := a.rules[identity]
+	if !ok {
+		return
+	}
+	delete(rules, export)
+	if len(rules) == 0 {
+		delete(a.rules, identity)
+	}
+}
+
+// Access returns the access of an identity to the export with the given name
+func (a *ACL) Access(identity, export string) Access {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	rules := a.rules[identity]
+	if access, ok := rules[export]; ok {
+		return access
+	}
+
+	return rules[AllExports]
+}
+
+// CertificateIdentity returns the common name of the verified client certificate
+// of a TLS connection, or the empty identity when the client sent none
+// or its certificate was not verified
+func CertificateIdentity(state tls.ConnectionState) string {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+
+	return state.VerifiedChains[0][0].Subject.CommonName
+}
+
+// identify sets the identity of the client
+// from the state of its TLS connection
+func (c *Connection) identify(state tls.ConnectionState) {
+	identify := c.server.Identify
+	if identify == nil {
+		identify = CertificateIdentity
+	}
+
+	c.identity = identify(state)
+}
+
+// access returns the access the client has to the given export
+func (c *Connection) access(export *Export) Access {
+	if c.server.ACL == nil {
+		return AccessReadWrite
+	}
+
+	return c.server.ACL.Access(c.identity, export.Name)
+}
+
+// readOnlyExport returns whether the given export is served read-only to the client,
+// either because of its configuration, its backend or the access of the client
+func (c *Connection) readOnlyExport(export *Export) bool {
+	if export.ReadOnly || c.access(export) == AccessReadOnly {
+		return true
+	}
+	if ro, ok := export.Backend.(backend.ReadOnlyer); ok {
+		return ro.ReadOnly()
+	}
+
+	return false
+}
@@ -0,0 +1,132 @@
+package nbd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestACL(t *testing.T) {
+	require := require.New(t)
+
+	acl := NewACL()
+	require.Equal(AccessDenied, acl.Access("alice", "vdisk"))
+
+	acl.Grant("alice", AllExports, AccessReadOnly)
+	acl.Grant("alice", "vdisk", AccessReadWrite)
+	require.Equal(AccessReadWrite, acl.Access("alice", "vdisk"))
+	require.Equal(AccessReadOnly, acl.Access("alice", "other"))
+	require.Equal(AccessDenied, acl.Access("bob", "vdisk"))
+
+	acl.Revoke("alice", "vdisk")
+	require.Equal(AccessReadOnly, acl.Access("alice", "vdisk"))
+	acl.Revoke("alice", AllExports)
+	require.Equal(AccessDenied, acl.Access("alice", "vdisk"))
+}
+
+func TestNegotiate_ACL(t *testing.T) {
+	require := require.New(t)
+
+	public, cleanup := newTestExport(t, "public")
+	defer cleanup()
+	golden, cleanup := newTestExport(t, "golden")
+	defer cleanup()
+	secret, cleanup := newTestExport(t, "secret")
+	defer cleanup()
+
+	serverCert, serverPool := newTestCertificate(t, "localhost")
+	clientCert, clientPool := newTestCertificate(t, "alice")
+
+	server := newTestServer(t, public, golden, secret)
+	server.TLSMode = TLSRequired
+	server.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientPool,
+	}
+	server.ACL = NewACL()
+	server.ACL.Grant("alice", "public", AccessReadWrite)
+	server.ACL.Grant("alice", "golden", AccessReadOnly)
+
+	client, result := startNegotiation(t, server)
+	defer client.Close()
+	tlsClient := startTLS(t, client, &tls.Config{
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      serverPool,
+		ServerName:   "localhost",
+	})
+
+	// denied exports are not listed
+	sendOpt(t, tlsClient, NBD_OPT_LIST, nil)
+	var names []string
+	for {
+		replyType, data := readOptReply(t, tlsClient, NBD_OPT_LIST)
+		if replyType == NBD_REP_ACK {
+			break
+		}
+		require.Equal(NBD_REP_SERVER, replyType)
+		nameLen := binary.BigEndian.Uint32(data)
+		names = append(names, string(data[4:4+nameLen]))
+	}
+	require.Equal([]string{"golden", "public"}, names)
+
+	// and can't be opened
+	sendInfoOpt(t, tlsClient, NBD_OPT_GO, "secret")
+	replyType, _ := readOptReply(t, tlsClient, NBD_OPT_GO)
+	require.Equal(NBD_REP_ERR_POLICY, replyType)
+
+	// read-only access is advertised to the client
+	sendInfoOpt(t, tlsClient, NBD_OPT_GO, "golden")
+	replyType, data := readOptReply(t, tlsClient, NBD_OPT_GO)
+	require.Equal(NBD_REP_INFO, replyType)
+	flags := binary.BigEndian.Uint16(data[10:])
+	require.NotZero(flags & NBD_FLAG_READ_ONLY)
+	replyType, _ = readOptReply(t, tlsClient, NBD_OPT_GO)
+	require.Equal(NBD_REP_ACK, replyType)
+	require.NoError((<-result).err)
+
+	// and enforced
+	sendRequest(t, tlsClient, NBD_CMD_WRITE, 0, 1, 0, 4)
+	_, err := tlsClient.Write(make([]byte, 4))
+	require.NoError(err)
+	require.Equal(uint32(NBD_EPERM), readReply(t, tlsClient, 1).NbdError)
+}
+
+func TestNegotiate_ACLExportName(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+
+	// clients that did not authenticate have the empty identity
+	server := newTestServer(t, export)
+	server.ACL = NewACL()
+	server.ACL.Grant("alice", "vdisk", AccessReadWrite)
+
+	client, result := startNegotiation(t, server)
+	defer client.Close()
+
+	sendOpt(t, client, NBD_OPT_EXPORT_NAME, []byte("vdisk"))
+	require.Error((<-result).err)
+}
+
+func TestCertificateIdentity(t *testing.T) {
+	require := require.New(t)
+
+	cert, _ := newTestCertificate(t, "alice")
+
+	require.Equal("", CertificateIdentity(tls.ConnectionState{}))
+
+	// certificates that were not verified don't identify the client
+	require.Equal("", CertificateIdentity(tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert.Leaf},
+	}))
+
+	require.Equal("alice", CertificateIdentity(tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert.Leaf},
+		VerifiedChains:   [][]*x509.Certificate{{cert.Leaf}},
+	}))
+}
@@ -1,6 +1,17 @@
 package backend
 
-import "context"
+import (
+	"context"
+	"errors"
+)
+
+var (
+	// ErrNoSpace is returned by backends that have no space left for a write
+	ErrNoSpace = errors.New("backend: no space left")
+	// ErrZeroNotSupported is returned by a WriteZeroer
+	// that can't zero a range efficiently
+	ErrZeroNotSupported = errors.New("backend: zeroing ranges is not supported")
+)
 
 // Backend represents an NBD backend
 type Backend interface {
@@ -10,3 +21,64 @@ type Backend interface {
 	Flush(ctx context.Context) error
 	Close(ctx context.Context) error
 }
+
+// FUAWriter is implemented by backends that can force
+// a single write to stable storage without flushing the whole backend
+type FUAWriter interface {
+	WriteAtFUA(ctx context.Context, b []byte, offset int64) (int64, error)
+}
+
+// ReadOnlyer is implemented by backends
+// that may refuse all writes, such as backends of read-only media.
+// Exports of backends that report being read-only are served read-only.
+type ReadOnlyer interface {
+	ReadOnly() bool
+}
+
+// Trimmer is implemented by backends
+// that can discard ranges of the backend
+type Trimmer interface {
+	Trim(ctx context.Context, offset, length int64) error
+}
+
+// WriteZeroer is implemented by backends
+// that can zero ranges of the backend without writing zeroes.
+// Unless noHole is set, the range may be deallocated.
+// ErrZeroNotSupported is returned when the range can't be zeroed efficiently,
+// in which case zeroes can be written instead.
+type WriteZeroer interface {
+	WriteZeroes(ctx context.Context, offset, length int64, noHole bool) error
+}
+
+// BlockStatuser is implemented by backends
+// that can report which ranges of the backend are allocated
+type BlockStatuser interface {
+	BlockStatus(ctx context.Context, offset, length int64) ([]Extent, error)
+}
+
+// Extent describes the allocation state of a range of a backend
+type Extent struct {
+	Offset int64
+	Length int64
+	// Hole is set when the range is not allocated
+	Hole bool
+	// Zero is set when the range reads as zeroes
+	Zero bool
+}
+
+// appendExtent appends an extent to a list of extents,
+// merging it with the last extent when they are adjacent and in the same state
+func appendExtent(extents []Extent, e Extent) []Extent {
+	if e.Length == 0 {
+		return extents
+	}
+	if n := len(extents); n > 0 {
+		last := &extents[n-1]
+		if last.Offset+last.Length == e.Offset && last.Hole == e.Hole && last.Zero == e.Zero {
+			last.Length += e.Length
+			return extents
+		}
+	}
+
+	return append(extents, e)
+}
@@ -0,0 +1,51 @@
+package backend
+
+import (
+	"os"
+	"syscall"
+)
+
+// whence values to find data and holes in sparse files
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// fileExtents returns the data and hole extents
+// of a range of a file using SEEK_DATA and SEEK_HOLE
+func fileExtents(file *os.File, offset, length int64) ([]Extent, error) {
+	var extents []Extent
+
+	end := offset + length
+	for offset < end {
+		data, err := file.Seek(offset, seekData)
+		if err != nil {
+			// there is no more data after the offset
+			if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.ENXIO {
+				data = end
+			} else {
+				return nil, err
+			}
+		}
+		if data > end {
+			data = end
+		}
+		extents = appendExtent(extents, Extent{Offset: offset, Length: data - offset, Hole: true, Zero: true})
+		offset = data
+		if offset >= end {
+			break
+		}
+
+		hole, err := file.Seek(offset, seekHole)
+		if err != nil {
+			return nil, err
+		}
+		if hole > end {
+			hole = end
+		}
+		extents = appendExtent(extents, Extent{Offset: offset, Length: hole - offset})
+		offset = hole
+	}
+
+	return extents, nil
+}
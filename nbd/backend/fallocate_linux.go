@@ -0,0 +1,39 @@
+package backend
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocate modes
+const (
+	fallocFlKeepSize  = 0x01
+	fallocFlPunchHole = 0x02
+	fallocFlZeroRange = 0x10
+)
+
+// punchHole deallocates a range of a file,
+// the range reads as zeroes afterwards
+func punchHole(file *os.File, offset, length int64) error {
+	return fallocate(file, fallocFlPunchHole|fallocFlKeepSize, offset, length)
+}
+
+// zeroRange zeroes a range of a file
+// while keeping the range allocated
+func zeroRange(file *os.File, offset, length int64) error {
+	return fallocate(file, fallocFlZeroRange|fallocFlKeepSize, offset, length)
+}
+
+// fallocate manipulates the allocation of a range of a file,
+// ErrZeroNotSupported is returned when the file system doesn't support the mode
+func fallocate(file *os.File, mode uint32, offset, length int64) error {
+	err := syscall.Fallocate(int(file.Fd()), mode, offset, length)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return ErrZeroNotSupported
+	}
+	if err != nil {
+		return os.NewSyscallError("fallocate", err)
+	}
+
+	return nil
+}
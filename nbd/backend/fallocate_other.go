@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package backend
+
+import "os"
+
+// punchHole is not supported on this platform
+func punchHole(file *os.File, offset, length int64) error {
+	return ErrZeroNotSupported
+}
+
+// zeroRange is not supported on this platform
+func zeroRange(file *os.File, offset, length int64) error {
+	return ErrZeroNotSupported
+}
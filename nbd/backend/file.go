@@ -48,3 +48,22 @@ func (f *File) Flush(ctx context.Context) error {
 func (f *File) Close(ctx context.Context) error {
 	return f.file.Close()
 }
+
+// Trim implements Trimmer.Trim
+func (f *File) Trim(ctx context.Context, offset, length int64) error {
+	return punchHole(f.file, offset, length)
+}
+
+// WriteZeroes implements WriteZeroer.WriteZeroes
+func (f *File) WriteZeroes(ctx context.Context, offset, length int64, noHole bool) error {
+	if noHole {
+		return zeroRange(f.file, offset, length)
+	}
+
+	return punchHole(f.file, offset, length)
+}
+
+// BlockStatus implements BlockStatuser.BlockStatus
+func (f *File) BlockStatus(ctx context.Context, offset, length int64) ([]Extent, error) {
+	return fileExtents(f.file, offset, length)
+}
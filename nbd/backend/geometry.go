@@ -0,0 +1,232 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Chunk sizes of a multi file backend
+const (
+	// MinChunkSize is the smallest chunk size of a multi file backend
+	MinChunkSize = 4 << 20
+	// MaxChunkSize is the largest chunk size of a multi file backend
+	MaxChunkSize = 1 << 30
+	// DefaultChunkSize is the chunk size used when none is configured
+	DefaultChunkSize = 16 << 20
+)
+
+// DescriptorVersion is the version of the descriptor format written by this package
+const DescriptorVersion = 1
+
+// Layout defines how the chunks of a multi file backend are spread over its files
+type Layout int
+
+const (
+	// LinearLayout concatenates the files,
+	// every file holds a single chunk
+	LinearLayout Layout = iota
+	// StripedLayout spreads consecutive chunks round-robin over the files
+	StripedLayout
+)
+
+// String implements fmt.Stringer
+func (l Layout) String() string {
+	switch l {
+	case LinearLayout:
+		return "linear"
+	case StripedLayout:
+		return "striped"
+	default:
+		return fmt.Sprintf("Layout(%d)", int(l))
+	}
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (l Layout) MarshalText() ([]byte, error) {
+	switch l {
+	case LinearLayout, StripedLayout:
+		return []byte(l.String()), nil
+	default:
+		return nil, fmt.Errorf("unknown layout %d", int(l))
+	}
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (l *Layout) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "linear":
+		*l = LinearLayout
+	case "striped":
+		*l = StripedLayout
+	default:
+		return fmt.Errorf("unknown layout `%s`", text)
+	}
+
+	return nil
+}
+
+// Geometry defines how the address space of a multi file backend
+// is spread over its files
+type Geometry struct {
+	// ChunkSize is a power of two between MinChunkSize and MaxChunkSize
+	ChunkSize int64  `json:"chunk_size"`
+	Layout    Layout `json:"layout"`
+}
+
+// DefaultGeometry returns the geometry of a multi file backend
+// that has none configured
+func DefaultGeometry() Geometry {
+	return Geometry{
+		ChunkSize: DefaultChunkSize,
+		Layout:    LinearLayout,
+	}
+}
+
+// Validate returns an error when the geometry can't be used
+// for a backend of the given size with the given number of files
+func (g Geometry) Validate(size uint64, files int) error {
+	if g.ChunkSize < MinChunkSize || g.ChunkSize > MaxChunkSize || g.ChunkSize&(g.ChunkSize-1) != 0 {
+		return fmt.Errorf("chunk size %d is not a power of two between %d and %d", g.ChunkSize, MinChunkSize, MaxChunkSize)
+	}
+	if files <= 0 {
+		return fmt.Errorf("a multi file backend needs at least one file")
+	}
+
+	switch g.Layout {
+	case LinearLayout:
+		if uint64(files)*uint64(g.ChunkSize) < size {
+			return fmt.Errorf("%d files of %d bytes can't hold %d bytes", files, g.ChunkSize, size)
+		}
+	case StripedLayout:
+	default:
+		return fmt.Errorf("unknown layout %d", int(g.Layout))
+	}
+
+	return nil
+}
+
+// FileSize returns the size of the file with the given index
+// of a backend of the given size with the given number of files
+func (g Geometry) FileSize(size uint64, files, index int) int64 {
+	chunks := (int64(size) + g.ChunkSize - 1) / g.ChunkSize
+	lastChunkSize := int64(size) - (chunks-1)*g.ChunkSize
+
+	var fileChunks int64
+	var holdsLast bool
+	switch g.Layout {
+	case StripedLayout:
+		fileChunks = chunks / int64(files)
+		if int64(index) < chunks%int64(files) {
+			fileChunks++
+		}
+		holdsLast = int64(index) == (chunks-1)%int64(files)
+	default:
+		if int64(index) < chunks {
+			fileChunks = 1
+		}
+		holdsLast = int64(index) == chunks-1
+	}
+
+	if fileChunks == 0 {
+		return 0
+	}
+	if holdsLast {
+		return (fileChunks-1)*g.ChunkSize + lastChunkSize
+	}
+	return fileChunks * g.ChunkSize
+}
+
+// locate returns the index of the file that holds the given offset,
+// the offset within that file and the length of the chunk that remains from there
+func (g Geometry) locate(offset int64, files int) (int, int64, int64) {
+	chunk := offset / g.ChunkSize
+	chunkOffset := offset % g.ChunkSize
+	remaining := g.ChunkSize - chunkOffset
+
+	if g.Layout == StripedLayout {
+		return int(chunk % int64(files)), (chunk/int64(files))*g.ChunkSize + chunkOffset, remaining
+	}
+	return int(chunk), chunkOffset, remaining
+}
+
+// Descriptor describes a multi file volume,
+// it is stored with the files, or in the manifest of a volume directory,
+// so the volume can be reopened with the same geometry
+type Descriptor struct {
+	Version int    `json:"version"`
+	Size    uint64 `json:"size"`
+	Files   int    `json:"files"`
+	Geometry
+}
+
+// Validate returns an error when the descriptor can't be used
+func (d Descriptor) Validate() error {
+	if d.Version != DescriptorVersion {
+		return fmt.Errorf("unsupported descriptor version %d", d.Version)
+	}
+
+	return d.Geometry.Validate(d.Size, d.Files)
+}
+
+// WriteDescriptor writes a descriptor to the file at the given path,
+// the file is replaced atomically
+func WriteDescriptor(path string, d Descriptor) error {
+	err := d.Validate()
+	if err != nil {
+		return err
+	}
+
+	return writeJSONFile(path, d)
+}
+
+// writeJSONFile writes a value as JSON to the file at the given path,
+// the file is replaced atomically and its directory is synced afterwards
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(append(data, '\n'))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(path))
+}
+
+// ReadDescriptor reads and validates the descriptor in the file at the given path
+func ReadDescriptor(path string) (Descriptor, error) {
+	var d Descriptor
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return d, err
+	}
+	err = json.Unmarshal(data, &d)
+	if err != nil {
+		return d, fmt.Errorf("invalid descriptor `%s`: %v", path, err)
+	}
+
+	return d, d.Validate()
+}
@@ -0,0 +1,79 @@
+package backend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGeometry_Validate(t *testing.T) {
+	require := require.New(t)
+
+	require.NoError(DefaultGeometry().Validate(2*DefaultChunkSize, 2))
+	require.NoError(Geometry{ChunkSize: MaxChunkSize, Layout: StripedLayout}.Validate(1<<40, 3))
+
+	// chunk sizes are powers of two within bounds
+	require.Error(Geometry{ChunkSize: MinChunkSize / 2}.Validate(0, 1))
+	require.Error(Geometry{ChunkSize: MaxChunkSize * 2}.Validate(0, 1))
+	require.Error(Geometry{ChunkSize: MinChunkSize + 1}.Validate(0, 1))
+
+	// linear files can't hold more than a chunk each
+	require.Error(DefaultGeometry().Validate(2*DefaultChunkSize+1, 2))
+	require.Error(DefaultGeometry().Validate(0, 0))
+	require.Error(Geometry{ChunkSize: MinChunkSize, Layout: Layout(42)}.Validate(0, 1))
+}
+
+func TestGeometry_FileSize(t *testing.T) {
+	require := require.New(t)
+
+	linear := Geometry{ChunkSize: MinChunkSize, Layout: LinearLayout}
+	size := uint64(2*MinChunkSize + 10)
+	require.Equal(int64(MinChunkSize), linear.FileSize(size, 4, 0))
+	require.Equal(int64(MinChunkSize), linear.FileSize(size, 4, 1))
+	require.Equal(int64(10), linear.FileSize(size, 4, 2))
+	require.Equal(int64(0), linear.FileSize(size, 4, 3))
+
+	// 5 chunks over 2 files, the last chunk is partial
+	striped := Geometry{ChunkSize: MinChunkSize, Layout: StripedLayout}
+	size = uint64(4*MinChunkSize + 10)
+	require.Equal(int64(2*MinChunkSize+10), striped.FileSize(size, 2, 0))
+	require.Equal(int64(2*MinChunkSize), striped.FileSize(size, 2, 1))
+}
+
+func TestDescriptor(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "nbd_test_descriptor")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "volume.json")
+
+	d := Descriptor{
+		Version:  DescriptorVersion,
+		Size:     8 * MinChunkSize,
+		Files:    4,
+		Geometry: Geometry{ChunkSize: MinChunkSize, Layout: StripedLayout},
+	}
+	require.NoError(WriteDescriptor(path, d))
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	require.Contains(string(data), `"layout": "striped"`)
+
+	read, err := ReadDescriptor(path)
+	require.NoError(err)
+	require.Equal(d, read)
+
+	// invalid descriptors are neither written nor read
+	d.Version = 42
+	require.Error(WriteDescriptor(path, d))
+	require.NoError(ioutil.WriteFile(path, []byte(`{"version": 42}`), 0644))
+	_, err = ReadDescriptor(path)
+	require.Error(err)
+	require.NoError(ioutil.WriteFile(path, []byte(`{"version": 1, "layout": "diagonal"}`), 0644))
+	_, err = ReadDescriptor(path)
+	require.Error(err)
+}
@@ -0,0 +1,214 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// memoryPageSize is the granularity at which a memory backend allocates memory
+const memoryPageSize = 4096
+
+// NewMemory returns a new backend that keeps its data in memory.
+// Memory is only allocated for the pages that are written to.
+func NewMemory(size uint64) *Memory {
+	return &Memory{
+		size:  size,
+		pages: make(map[int64][]byte),
+	}
+}
+
+// Memory represents a sparse in-memory backend,
+// its data is lost once it is closed
+type Memory struct {
+	// MaxMemory is the maximum number of bytes the backend allocates,
+	// writes that need more memory fail with ErrNoSpace.
+	// The memory isn't limited when it is not set.
+	MaxMemory uint64
+
+	size uint64
+
+	mu sync.RWMutex
+	// pages holds the allocated pages by their index
+	pages map[int64][]byte
+}
+
+// Size implements Backend.Size
+func (m *Memory) Size() uint64 {
+	return m.size
+}
+
+// Allocated returns the number of bytes of memory allocated by the backend
+func (m *Memory) Allocated() uint64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return uint64(len(m.pages)) * memoryPageSize
+}
+
+// WriteAt implements Backend.WriteAt
+func (m *Memory) WriteAt(ctx context.Context, b []byte, offset int64) (int64, error) {
+	err := m.checkRange(offset, int64(len(b)))
+	if err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// allocate all pages up front so a full backend fails without partial writes
+	var missing uint64
+	m.forEachPage(offset, int64(len(b)), func(index, pageOffset, n, pos int64) {
+		if m.pages[index] == nil && !isZero(b[pos:pos+n]) {
+			missing++
+		}
+	})
+	if m.MaxMemory > 0 && (uint64(len(m.pages))+missing)*memoryPageSize > m.MaxMemory {
+		return 0, ErrNoSpace
+	}
+
+	m.forEachPage(offset, int64(len(b)), func(index, pageOffset, n, pos int64) {
+		page := m.pages[index]
+		if page == nil {
+			// zeroes don't need to be allocated
+			if isZero(b[pos : pos+n]) {
+				return
+			}
+			page = make([]byte, memoryPageSize)
+			m.pages[index] = page
+		}
+		copy(page[pageOffset:pageOffset+n], b[pos:pos+n])
+	})
+
+	return int64(len(b)), nil
+}
+
+// ReadAt implements Backend.ReadAt
+func (m *Memory) ReadAt(ctx context.Context, offset, length int64) ([]byte, error) {
+	err := m.checkRange(offset, length)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	bytes := make([]byte, length)
+	m.forEachPage(offset, length, func(index, pageOffset, n, pos int64) {
+		if page := m.pages[index]; page != nil {
+			copy(bytes[pos:pos+n], page[pageOffset:pageOffset+n])
+		}
+	})
+
+	return bytes, nil
+}
+
+// Flush implements Backend.Flush
+func (m *Memory) Flush(ctx context.Context) error {
+	return nil
+}
+
+// Close implements Backend.Close,
+// the memory of the backend is released
+func (m *Memory) Close(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.pages = make(map[int64][]byte)
+
+	return nil
+}
+
+// Trim implements Trimmer.Trim
+func (m *Memory) Trim(ctx context.Context, offset, length int64) error {
+	return m.WriteZeroes(ctx, offset, length, false)
+}
+
+// WriteZeroes implements WriteZeroer.WriteZeroes,
+// pages that are zeroed entirely are released unless noHole is set
+func (m *Memory) WriteZeroes(ctx context.Context, offset, length int64, noHole bool) error {
+	err := m.checkRange(offset, length)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.forEachPage(offset, length, func(index, pageOffset, n, pos int64) {
+		page := m.pages[index]
+		if page == nil {
+			return
+		}
+		if n == memoryPageSize && !noHole {
+			delete(m.pages, index)
+			return
+		}
+		for i := pageOffset; i < pageOffset+n; i++ {
+			page[i] = 0
+		}
+	})
+
+	return nil
+}
+
+// BlockStatus implements BlockStatuser.BlockStatus,
+// pages that were never written to are reported as holes
+func (m *Memory) BlockStatus(ctx context.Context, offset, length int64) ([]Extent, error) {
+	err := m.checkRange(offset, length)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var extents []Extent
+	m.forEachPage(offset, length, func(index, pageOffset, n, pos int64) {
+		e := Extent{Offset: offset + pos, Length: n}
+		if m.pages[index] == nil {
+			e.Hole, e.Zero = true, true
+		}
+		extents = appendExtent(extents, e)
+	})
+
+	return extents, nil
+}
+
+// checkRange returns an error when a range is not within the backend
+func (m *Memory) checkRange(offset, length int64) error {
+	if offset < 0 || length < 0 || uint64(offset)+uint64(length) > m.size {
+		return errors.New("Invalid memory address")
+	}
+
+	return nil
+}
+
+// forEachPage calls fn for every page that is part of the given range,
+// with the index of the page, the offset within that page,
+// the length of the range that is in that page
+// and the position of that part within the range
+func (m *Memory) forEachPage(offset, length int64, fn func(index, pageOffset, n, pos int64)) {
+	var pos int64
+	for pos < length {
+		index, pageOffset := (offset+pos)/memoryPageSize, (offset+pos)%memoryPageSize
+		n := memoryPageSize - pageOffset
+		if n > length-pos {
+			n = length - pos
+		}
+
+		fn(index, pageOffset, n, pos)
+		pos += n
+	}
+}
+
+// isZero returns whether b only holds zeroes
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,140 @@
+package backend
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemory(t *testing.T) {
+	require := require.New(t)
+
+	b := NewMemory(4 * memoryPageSize)
+	require.Equal(uint64(4*memoryPageSize), b.Size())
+
+	// untouched memory reads as zeroes and costs nothing
+	d, err := b.ReadAt(nil, 0, 4*memoryPageSize)
+	require.NoError(err)
+	require.Equal(make([]byte, 4*memoryPageSize), d)
+	require.Equal(uint64(0), b.Allocated())
+
+	// writes across a page boundary
+	n, err := b.WriteAt(nil, helloWorld, memoryPageSize-5)
+	require.NoError(err)
+	require.Equal(helloWorldLen, int(n))
+	d, err = b.ReadAt(nil, memoryPageSize-5, int64(helloWorldLen))
+	require.NoError(err)
+	require.Equal(helloWorld, d)
+	require.Equal(uint64(2*memoryPageSize), b.Allocated())
+
+	// writing zeroes to untouched pages doesn't allocate them
+	_, err = b.WriteAt(nil, make([]byte, memoryPageSize), 3*memoryPageSize)
+	require.NoError(err)
+	require.Equal(uint64(2*memoryPageSize), b.Allocated())
+
+	// ranges outside of the backend
+	_, err = b.WriteAt(nil, helloWorld, 4*memoryPageSize-5)
+	require.Error(err)
+	_, err = b.ReadAt(nil, -1, 1)
+	require.Error(err)
+
+	require.NoError(b.Close(nil))
+	require.Equal(uint64(0), b.Allocated())
+}
+
+func TestMemory_Zeroes(t *testing.T) {
+	require := require.New(t)
+
+	b := NewMemory(4 * memoryPageSize)
+	data := make([]byte, 4*memoryPageSize)
+	for i := range data {
+		data[i] = 1
+	}
+	_, err := b.WriteAt(nil, data, 0)
+	require.NoError(err)
+
+	// pages zeroed entirely are released
+	require.NoError(b.Trim(nil, memoryPageSize-10, memoryPageSize+20))
+	require.Equal(uint64(3*memoryPageSize), b.Allocated())
+	extents, err := b.BlockStatus(nil, 0, 4*memoryPageSize)
+	require.NoError(err)
+	require.Equal([]Extent{
+		{Offset: 0, Length: memoryPageSize},
+		{Offset: memoryPageSize, Length: memoryPageSize, Hole: true, Zero: true},
+		{Offset: 2 * memoryPageSize, Length: 2 * memoryPageSize},
+	}, extents)
+
+	// unless they may not be
+	require.NoError(b.WriteZeroes(nil, 2*memoryPageSize, memoryPageSize, true))
+	require.Equal(uint64(3*memoryPageSize), b.Allocated())
+	require.NoError(b.WriteZeroes(nil, 3*memoryPageSize, memoryPageSize, false))
+	require.Equal(uint64(2*memoryPageSize), b.Allocated())
+
+	expected := make([]byte, 4*memoryPageSize)
+	for i := 0; i < memoryPageSize-10; i++ {
+		expected[i] = 1
+	}
+	d, err := b.ReadAt(nil, 0, 4*memoryPageSize)
+	require.NoError(err)
+	require.Equal(expected, d)
+}
+
+func TestMemory_MaxMemory(t *testing.T) {
+	require := require.New(t)
+
+	b := NewMemory(4 * memoryPageSize)
+	b.MaxMemory = 2 * memoryPageSize
+
+	_, err := b.WriteAt(nil, helloWorld, 0)
+	require.NoError(err)
+
+	// writes that need too much memory fail without writing anything
+	_, err = b.WriteAt(nil, helloWorld, 2*memoryPageSize-5)
+	require.Equal(ErrNoSpace, err)
+	d, err := b.ReadAt(nil, memoryPageSize, 1)
+	require.NoError(err)
+	require.Equal([]byte{0}, d)
+
+	_, err = b.WriteAt(nil, helloWorld, memoryPageSize)
+	require.NoError(err)
+
+	// released memory can be used again
+	require.NoError(b.Trim(nil, 0, memoryPageSize))
+	_, err = b.WriteAt(nil, helloWorld, 3*memoryPageSize)
+	require.NoError(err)
+	require.Equal(uint64(2*memoryPageSize), b.Allocated())
+}
+
+func TestMemory_Reference(t *testing.T) {
+	require := require.New(t)
+
+	const size = 64 * memoryPageSize
+	b := NewMemory(size)
+	reference := make([]byte, size)
+
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		offset := rnd.Int63n(size)
+		length := rnd.Int63n(4*memoryPageSize) + 1
+		if offset+length > size {
+			length = size - offset
+		}
+
+		switch rnd.Intn(3) {
+		case 0:
+			data := make([]byte, length)
+			rnd.Read(data)
+			_, err := b.WriteAt(nil, data, offset)
+			require.NoError(err)
+			copy(reference[offset:], data)
+		case 1:
+			require.NoError(b.Trim(nil, offset, length))
+			copy(reference[offset:offset+length], make([]byte, length))
+		default:
+			d, err := b.ReadAt(nil, offset, length)
+			require.NoError(err)
+			require.Equal(reference[offset:offset+length], d, "read of %d bytes at %d differs from the reference", length, offset)
+		}
+	}
+}
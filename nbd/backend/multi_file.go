@@ -4,30 +4,64 @@ import (
 	"context"
 	"errors"
 	"os"
+	"sync"
 )
 
-const (
-	// MaxSingleFileSize is the maximum size for a single file
-	// for a multi file backend
-	MaxSingleFileSize = 0x00ffffff
-)
-
-// NewMultiFile returns a new backend that has multiple files
+// NewMultiFile returns a new backend that has multiple files,
+// which are concatenated in chunks of DefaultChunkSize
 func NewMultiFile(files []*os.File, totalSize uint64) *MultiFile {
 	return &MultiFile{
-		files: files,
-		size:  totalSize,
+		files:    files,
+		size:     totalSize,
+		geometry: DefaultGeometry(),
 	}
 }
 
+// NewMultiFileWithGeometry returns a new backend that has multiple files,
+// over which the address space is spread as defined by the given geometry
+func NewMultiFileWithGeometry(files []*os.File, totalSize uint64, geometry Geometry) (*MultiFile, error) {
+	err := geometry.Validate(totalSize, len(files))
+	if err != nil {
+		return nil, err
+	}
+
+	return &MultiFile{
+		files:    files,
+		size:     totalSize,
+		geometry: geometry,
+	}, nil
+}
+
 // MultiFile represents a multiple file backend
 //
-// A multifile backend uses the first byte of the block address to identify
-// the file to write to while the last 3 bytes indicate
-// the position within that file.
+// A multifile backend splits its address space in chunks,
+// which are spread over its files as defined by its geometry.
+// With the default geometry every file holds a single chunk of 16 MiB,
+// so the first byte of the block address identifies the file to write to
+// while the last 3 bytes indicate the position within that file.
+//
+// Files can be absent until they are first written to,
+// absent files read as zeroes and are reported as holes.
 type MultiFile struct {
+	size     uint64
+	geometry Geometry
+
+	// mu guards files, absent files are nil
+	mu    sync.RWMutex
 	files []*os.File
-	size  uint64
+	// allocate creates the absent file with the given index,
+	// it is nil when all files are present
+	allocate func(index int) (*os.File, error)
+}
+
+// Descriptor returns the descriptor of the volume made up by the files of the backend
+func (f *MultiFile) Descriptor() Descriptor {
+	return Descriptor{
+		Version:  DescriptorVersion,
+		Size:     f.size,
+		Files:    len(f.files),
+		Geometry: f.geometry,
+	}
 }
 
 // Size implements Backend.Size
@@ -35,34 +69,62 @@ func (f *MultiFile) Size() uint64 {
 	return f.size
 }
 
-// WriteAt implements Backend.WriteAt
+// WriteAt implements Backend.WriteAt,
+// writes that span multiple files are split across those files
 func (f *MultiFile) WriteAt(ctx context.Context, b []byte, offset int64) (int64, error) {
-	file, err := f.getFile(offset)
+	var written int64
+	err := f.forEachFile(offset, int64(len(b)), true, func(file *os.File, fileOffset, n int64) error {
+		nw, err := file.WriteAt(b[written:written+n], fileOffset)
+		written += int64(nw)
+		return err
+	})
+
+	return written, err
+}
+
+// WriteAtFUA implements FUAWriter.WriteAtFUA,
+// only the files that were written to are synced
+func (f *MultiFile) WriteAtFUA(ctx context.Context, b []byte, offset int64) (int64, error) {
+	n, err := f.WriteAt(ctx, b, offset)
 	if err != nil {
-		return 0, err
+		return n, err
 	}
 
-	n, err := file.WriteAt(b, offset&MaxSingleFileSize)
+	err = f.forEachFile(offset, int64(len(b)), false, func(file *os.File, fileOffset, n int64) error {
+		return file.Sync()
+	})
 
-	return int64(n), err
+	return n, err
 }
 
-// ReadAt implements Backend.ReadAt
+// ReadAt implements Backend.ReadAt,
+// reads that span multiple files are reassembled from those files
 func (f *MultiFile) ReadAt(ctx context.Context, offset, length int64) ([]byte, error) {
-	file, err := f.getFile(offset)
-	if err != nil {
-		return nil, err
-	}
-
 	bytes := make([]byte, length)
-	_, err = file.ReadAt(bytes, offset&MaxSingleFileSize)
+	var read int64
+	err := f.forEachFile(offset, length, false, func(file *os.File, fileOffset, n int64) error {
+		if file == nil {
+			// absent files only hold zeroes
+			read += n
+			return nil
+		}
+		_, err := file.ReadAt(bytes[read:read+n], fileOffset)
+		read += n
+		return err
+	})
 
 	return bytes, err
 }
 
 // Flush implements Backend.Flush
 func (f *MultiFile) Flush(ctx context.Context) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
 	for _, f := range f.files {
+		if f == nil {
+			continue
+		}
 		err := f.Sync()
 		if err != nil {
 			return err
@@ -72,9 +134,66 @@ func (f *MultiFile) Flush(ctx context.Context) error {
 	return nil
 }
 
+// Trim implements Trimmer.Trim
+func (f *MultiFile) Trim(ctx context.Context, offset, length int64) error {
+	return f.forEachFile(offset, length, false, func(file *os.File, fileOffset, n int64) error {
+		if file == nil {
+			return nil
+		}
+		return punchHole(file, fileOffset, n)
+	})
+}
+
+// WriteZeroes implements WriteZeroer.WriteZeroes
+func (f *MultiFile) WriteZeroes(ctx context.Context, offset, length int64, noHole bool) error {
+	// absent files already read as zeroes, but have to be allocated
+	// when the zeroed range has to be
+	return f.forEachFile(offset, length, noHole, func(file *os.File, fileOffset, n int64) error {
+		if file == nil {
+			return nil
+		}
+		if noHole {
+			return zeroRange(file, fileOffset, n)
+		}
+		return punchHole(file, fileOffset, n)
+	})
+}
+
+// BlockStatus implements BlockStatuser.BlockStatus
+func (f *MultiFile) BlockStatus(ctx context.Context, offset, length int64) ([]Extent, error) {
+	var extents []Extent
+	err := f.forEachFile(offset, length, false, func(file *os.File, fileOffset, n int64) error {
+		if file == nil {
+			extents = appendExtent(extents, Extent{Offset: offset, Length: n, Hole: true, Zero: true})
+			offset += n
+			return nil
+		}
+		fileExtents, err := fileExtents(file, fileOffset, n)
+		if err != nil {
+			return err
+		}
+		// translate file offsets to backend offsets
+		for _, e := range fileExtents {
+			e.Offset += offset - fileOffset
+			extents = appendExtent(extents, e)
+		}
+		offset += n
+
+		return nil
+	})
+
+	return extents, err
+}
+
 // Close implements Backend.Close
 func (f *MultiFile) Close(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
 	for _, f := range f.files {
+		if f == nil {
+			continue
+		}
 		err := f.Close()
 		if err != nil {
 			return err
@@ -84,13 +203,80 @@ func (f *MultiFile) Close(ctx context.Context) error {
 	return nil
 }
 
-// GetFile returns the file corresponding to the first byte of the address
-func (f *MultiFile) getFile(reqAddress int64) (*os.File, error) {
-	fileAddr := reqAddress / MaxSingleFileSize
+// GetFile returns the file corresponding to the address
+// and the offset of the address within that file,
+// the file is nil when it is absent
+func (f *MultiFile) getFile(reqAddress int64) (*os.File, int64, error) {
+	return f.file(reqAddress, false)
+}
+
+// file returns the file corresponding to the address
+// and the offset of the address within that file,
+// an absent file is allocated when allocate is true
+func (f *MultiFile) file(reqAddress int64, allocate bool) (*os.File, int64, error) {
+	if reqAddress < 0 {
+		return nil, 0, errors.New("Invalid file address")
+	}
+
+	index, fileOffset, _ := f.geometry.locate(reqAddress, len(f.files))
+	if index >= len(f.files) {
+		return nil, 0, errors.New("Invalid file address")
+	}
+
+	f.mu.RLock()
+	file := f.files[index]
+	f.mu.RUnlock()
+	if file != nil || !allocate {
+		return file, fileOffset, nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// another request might have allocated the file in the meantime
+	if f.files[index] == nil {
+		if f.allocate == nil {
+			return nil, 0, errors.New("File can't be allocated")
+		}
+		file, err := f.allocate(index)
+		if err != nil {
+			return nil, 0, err
+		}
+		f.files[index] = file
+	}
+
+	return f.files[index], fileOffset, nil
+}
+
+// forEachFile calls fn for every chunk that is part of the given range,
+// with the file holding the chunk, the offset within that file
+// and the length of the range that is in that chunk.
+// The file is nil when it is absent, unless allocate is true.
+// Ranges that are not within the backend are refused,
+// so writes can't grow the last chunk past the size of the backend.
+func (f *MultiFile) forEachFile(offset, length int64, allocate bool, fn func(file *os.File, fileOffset, n int64) error) error {
+	if offset < 0 || length < 0 || uint64(offset)+uint64(length) > f.size {
+		return errors.New("Invalid file address")
+	}
 
-	if int(fileAddr) >= len(f.files) {
-		return nil, errors.New("Invalid file address")
+	for length > 0 {
+		file, fileOffset, err := f.file(offset, allocate)
+		if err != nil {
+			return err
+		}
+
+		n := f.geometry.ChunkSize - offset%f.geometry.ChunkSize
+		if n > length {
+			n = length
+		}
+
+		err = fn(file, fileOffset, n)
+		if err != nil {
+			return err
+		}
+
+		offset += n
+		length -= n
 	}
 
-	return f.files[fileAddr], nil
+	return nil
 }
@@ -0,0 +1,267 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// manifestName is the name of the file describing a multi file volume,
+// within the directory of the volume
+const manifestName = "manifest.json"
+
+// manifest describes a multi file volume and the chunk files it allocated
+type manifest struct {
+	Descriptor
+	// Allocated holds the indices of the chunk files that were created,
+	// the other chunk files are absent until they are written to
+	Allocated []int `json:"allocated,omitempty"`
+}
+
+// OpenMultiFileDir opens the multi file volume stored in the directory at the given path.
+// When the directory holds no volume yet, it is created as described by d,
+// otherwise the volume has to match d, unless d is the zero Descriptor,
+// which only opens existing volumes.
+//
+// The volume is thin provisioned: its chunk files are only created
+// when they are first written to, as sparse files.
+// Volumes of which allocated chunk files are missing or have the wrong size are refused.
+func OpenMultiFileDir(path string, d Descriptor) (*MultiFile, error) {
+	m, err := readManifest(path)
+	if os.IsNotExist(err) {
+		if d == (Descriptor{}) {
+			return nil, fmt.Errorf("no multi file volume found in `%s`", path)
+		}
+		m, err = createMultiFileDir(path, d)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if d != (Descriptor{}) && !sameVolume(m.Descriptor, d) {
+		return nil, fmt.Errorf("volume in `%s` has size %d over %d files with %s chunks of %d bytes, expected size %d over %d files with %s chunks of %d bytes",
+			path, m.Size, m.Files, m.Layout, m.ChunkSize, d.Size, d.Files, d.Layout, d.ChunkSize)
+	}
+
+	allocated := make(map[int]bool, len(m.Allocated))
+	for _, index := range m.Allocated {
+		allocated[index] = true
+	}
+
+	files := make([]*os.File, m.Files)
+	for i := range files {
+		file, err := openChunkFile(path, m.Descriptor, i, allocated[i])
+		if err != nil {
+			closeFiles(files)
+			return nil, err
+		}
+		if file == nil && allocated[i] {
+			closeFiles(files)
+			return nil, fmt.Errorf("chunk file `%s` is missing", chunkFileName(path, i))
+		}
+		if file != nil && !allocated[i] {
+			// the file was created, but the manifest wasn't updated yet,
+			// no data was written to it before that
+			m.Allocated = append(m.Allocated, i)
+		}
+		files[i] = file
+	}
+
+	b, err := NewMultiFileWithGeometry(files, m.Size, m.Geometry)
+	if err != nil {
+		closeFiles(files)
+		return nil, err
+	}
+	b.allocate = func(index int) (*os.File, error) {
+		return allocateChunkFile(path, &m, index)
+	}
+
+	return b, nil
+}
+
+// createMultiFileDir creates the manifest of an empty multi file volume
+// in the directory at the given path
+func createMultiFileDir(path string, d Descriptor) (manifest, error) {
+	if d.Version == 0 {
+		d.Version = DescriptorVersion
+	}
+	m := manifest{Descriptor: d}
+	err := d.Validate()
+	if err != nil {
+		return m, err
+	}
+
+	err = os.MkdirAll(path, 0755)
+	if err != nil {
+		return m, err
+	}
+
+	// chunk files without a manifest belong to a volume that lost its manifest
+	stale, err := filepath.Glob(filepath.Join(path, "chunk-*"))
+	if err != nil {
+		return m, err
+	}
+	if len(stale) > 0 {
+		return m, fmt.Errorf("`%s` holds chunk files but no manifest", path)
+	}
+
+	// the volume directory itself has to survive a crash too
+	err = syncDir(filepath.Dir(path))
+	if err != nil {
+		return m, err
+	}
+
+	return m, writeManifest(path, m)
+}
+
+// allocateChunkFile creates the sparse chunk file with the given index of a volume
+// and records it in the manifest of the volume.
+// The chunk file and the manifest are synced before data is written to the file,
+// so acknowledged writes aren't lost with the file after a crash.
+func allocateChunkFile(path string, m *manifest, index int) (*os.File, error) {
+	name := chunkFileName(path, index)
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = file.Truncate(m.FileSize(m.Size, m.Files, index))
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = syncDir(path)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(name)
+		return nil, err
+	}
+
+	allocated := append(append([]int(nil), m.Allocated...), index)
+	sort.Ints(allocated)
+	err = writeManifest(path, manifest{
+		Descriptor: m.Descriptor,
+		Allocated:  allocated,
+	})
+	if err != nil {
+		file.Close()
+		os.Remove(name)
+		return nil, err
+	}
+	m.Allocated = allocated
+
+	return file, nil
+}
+
+// openChunkFile opens the chunk file with the given index of a volume
+// and checks that it has the size the volume expects,
+// nil is returned when the file is absent.
+// Files that aren't allocated in the manifest and have the wrong size
+// were left behind by a crash while they were allocated,
+// they never held data and are removed.
+func openChunkFile(path string, d Descriptor, index int, allocated bool) (*os.File, error) {
+	name := chunkFileName(path, index)
+	file, err := os.OpenFile(name, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	expected := d.FileSize(d.Size, d.Files, index)
+	if !allocated && info.Size() != expected {
+		file.Close()
+		err = os.Remove(name)
+		if err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+	if info.Size() < expected {
+		file.Close()
+		return nil, fmt.Errorf("chunk file `%s` is truncated to %d bytes, expected %d", name, info.Size(), expected)
+	}
+	if info.Size() > expected {
+		file.Close()
+		return nil, fmt.Errorf("chunk file `%s` has %d bytes, expected %d", name, info.Size(), expected)
+	}
+
+	return file, nil
+}
+
+// readManifest reads and validates the manifest of the volume directory at the given path
+func readManifest(path string) (manifest, error) {
+	var m manifest
+
+	path = filepath.Join(path, manifestName)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		return m, fmt.Errorf("invalid manifest `%s`: %v", path, err)
+	}
+	err = m.Validate()
+	if err != nil {
+		return m, err
+	}
+	for _, index := range m.Allocated {
+		if index < 0 || index >= m.Files {
+			return m, fmt.Errorf("invalid manifest `%s`: chunk file %d is out of range", path, index)
+		}
+	}
+
+	return m, nil
+}
+
+// writeManifest validates a manifest and writes it to the volume directory at the given path.
+// The manifest is replaced atomically and the directory is synced afterwards.
+func writeManifest(path string, m manifest) error {
+	err := m.Validate()
+	if err != nil {
+		return err
+	}
+
+	return writeJSONFile(filepath.Join(path, manifestName), m)
+}
+
+// syncDir commits the entries of the directory at the given path to stable storage
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+// chunkFileName returns the path of the chunk file with the given index
+// of the volume in the directory at the given path
+func chunkFileName(path string, index int) string {
+	return filepath.Join(path, fmt.Sprintf("chunk-%05d", index))
+}
+
+// sameVolume returns whether two descriptors describe the same volume
+func sameVolume(a, b Descriptor) bool {
+	return a.Size == b.Size && a.Files == b.Files && a.Geometry == b.Geometry
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package backend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenMultiFileDir(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "nbd_test_volume")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "volume")
+
+	d := Descriptor{
+		Size:     3*MinChunkSize + 512,
+		Files:    2,
+		Geometry: Geometry{ChunkSize: MinChunkSize, Layout: StripedLayout},
+	}
+
+	// existing volumes only are opened without a descriptor
+	_, err = OpenMultiFileDir(path, Descriptor{})
+	require.Error(err)
+
+	b, err := OpenMultiFileDir(path, d)
+	require.NoError(err)
+	require.Equal(d.Size, b.Size())
+	_, err = b.WriteAt(nil, helloWorld, 3*MinChunkSize)
+	require.NoError(err)
+	require.NoError(b.Close(nil))
+
+	// data survives reopening the volume
+	b, err = OpenMultiFileDir(path, Descriptor{})
+	require.NoError(err)
+	d.Version = DescriptorVersion
+	require.Equal(d, b.Descriptor())
+	data, err := b.ReadAt(nil, 3*MinChunkSize, int64(helloWorldLen))
+	require.NoError(err)
+	require.Equal(helloWorld, data)
+	require.NoError(b.Close(nil))
+
+	b, err = OpenMultiFileDir(path, d)
+	require.NoError(err)
+	require.NoError(b.Close(nil))
+
+	// a volume that doesn't match the descriptor is refused
+	other := d
+	other.Size *= 2
+	_, err = OpenMultiFileDir(path, other)
+	require.Error(err)
+}
+
+func TestOpenMultiFileDir_OutOfRange(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "nbd_test_volume")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	// the last chunk is only partially part of the volume
+	d := Descriptor{
+		Size:     MinChunkSize + MinChunkSize/2,
+		Files:    2,
+		Geometry: Geometry{ChunkSize: MinChunkSize, Layout: LinearLayout},
+	}
+	b, err := OpenMultiFileDir(dir, d)
+	require.NoError(err)
+	_, err = b.WriteAt(nil, helloWorld, MinChunkSize)
+	require.NoError(err)
+
+	// ranges past the end of the volume are refused
+	_, err = b.WriteAt(nil, []byte("x"), int64(d.Size))
+	require.Error(err)
+	_, err = b.WriteAt(nil, helloWorld, int64(d.Size)-1)
+	require.Error(err)
+	_, err = b.ReadAt(nil, int64(d.Size), 1)
+	require.Error(err)
+	require.Error(b.WriteZeroes(nil, int64(d.Size)-1, 2, true))
+	require.Error(b.Trim(nil, int64(d.Size), 1))
+	require.NoError(b.Close(nil))
+
+	// and don't grow the chunk files of the volume
+	b, err = OpenMultiFileDir(dir, d)
+	require.NoError(err)
+	data, err := b.ReadAt(nil, MinChunkSize, int64(helloWorldLen))
+	require.NoError(err)
+	require.Equal(helloWorld, data)
+	require.NoError(b.Close(nil))
+}
+
+func TestOpenMultiFileDir_Corrupt(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "nbd_test_volume")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	d := Descriptor{
+		Size:     2 * MinChunkSize,
+		Files:    2,
+		Geometry: Geometry{ChunkSize: MinChunkSize, Layout: LinearLayout},
+	}
+	b, err := OpenMultiFileDir(dir, d)
+	require.NoError(err)
+	_, err = b.WriteAt(nil, helloWorld, MinChunkSize)
+	require.NoError(err)
+	require.NoError(b.Close(nil))
+
+	// truncated chunk files
+	name := chunkFileName(dir, 1)
+	require.NoError(os.Truncate(name, MinChunkSize-1))
+	_, err = OpenMultiFileDir(dir, d)
+	require.Error(err)
+	require.Contains(err.Error(), "truncated")
+
+	// chunk files that grew
+	require.NoError(os.Truncate(name, MinChunkSize+1))
+	_, err = OpenMultiFileDir(dir, d)
+	require.Error(err)
+
+	// missing chunk files
+	require.NoError(os.Remove(name))
+	_, err = OpenMultiFileDir(dir, d)
+	require.Error(err)
+	require.Contains(err.Error(), "missing")
+
+	// chunk files without a manifest
+	require.NoError(os.Remove(filepath.Join(dir, manifestName)))
+	require.NoError(ioutil.WriteFile(chunkFileName(dir, 0), nil, 0644))
+	_, err = OpenMultiFileDir(dir, d)
+	require.Error(err)
+
+	// a corrupt manifest
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, manifestName), []byte("{"), 0644))
+	_, err = OpenMultiFileDir(dir, d)
+	require.Error(err)
+}
+
+func TestOpenMultiFileDir_Lazy(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "nbd_test_volume")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	d := Descriptor{
+		Size:     4 * MinChunkSize,
+		Files:    4,
+		Geometry: Geometry{ChunkSize: MinChunkSize, Layout: LinearLayout},
+	}
+	b, err := OpenMultiFileDir(dir, d)
+	require.NoError(err)
+
+	// no chunk files are created up front
+	chunks, err := filepath.Glob(filepath.Join(dir, "chunk-*"))
+	require.NoError(err)
+	require.Empty(chunks)
+
+	// absent chunk files read as zeroes and are holes
+	data, err := b.ReadAt(nil, MinChunkSize-5, 10)
+	require.NoError(err)
+	require.Equal(make([]byte, 10), data)
+	extents, err := b.BlockStatus(nil, 0, 4*MinChunkSize)
+	require.NoError(err)
+	require.Equal([]Extent{{Offset: 0, Length: 4 * MinChunkSize, Hole: true, Zero: true}}, extents)
+	require.NoError(b.Trim(nil, 0, MinChunkSize))
+	require.NoError(b.WriteZeroes(nil, 0, MinChunkSize, false))
+	chunks, err = filepath.Glob(filepath.Join(dir, "chunk-*"))
+	require.NoError(err)
+	require.Empty(chunks)
+
+	// concurrent writes to an absent chunk file allocate it once
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := b.WriteAt(nil, []byte{byte(i + 1)}, 2*MinChunkSize+int64(i))
+			require.NoError(err)
+		}(i)
+	}
+	wg.Wait()
+	chunks, err = filepath.Glob(filepath.Join(dir, "chunk-*"))
+	require.NoError(err)
+	require.Equal([]string{chunkFileName(dir, 2)}, chunks)
+	info, err := os.Stat(chunks[0])
+	require.NoError(err)
+	require.Equal(int64(MinChunkSize), info.Size())
+
+	extents, err = b.BlockStatus(nil, 0, 4*MinChunkSize)
+	require.NoError(err)
+	require.Len(extents, 3)
+	require.Equal(Extent{Offset: 0, Length: 2 * MinChunkSize, Hole: true, Zero: true}, extents[0])
+	require.False(extents[1].Hole)
+	require.Equal(int64(2*MinChunkSize), extents[1].Offset)
+
+	// zeroes that may not be holes allocate their chunk file
+	require.NoError(b.WriteZeroes(nil, 3*MinChunkSize, 4096, true))
+	require.NoError(b.Close(nil))
+
+	m, err := readManifest(dir)
+	require.NoError(err)
+	require.Equal([]int{2, 3}, m.Allocated)
+
+	// the data survives reopening the volume
+	b, err = OpenMultiFileDir(dir, Descriptor{})
+	require.NoError(err)
+	data, err = b.ReadAt(nil, 2*MinChunkSize, 8)
+	require.NoError(err)
+	require.Equal([]byte{1, 2, 3, 4, 5, 6, 7, 8}, data)
+	require.NoError(b.Close(nil))
+
+	// chunk files created before the manifest was updated are adopted
+	require.NoError(ioutil.WriteFile(chunkFileName(dir, 0), nil, 0644))
+	require.NoError(os.Truncate(chunkFileName(dir, 0), MinChunkSize))
+	b, err = OpenMultiFileDir(dir, d)
+	require.NoError(err)
+	_, err = b.WriteAt(nil, helloWorld, MinChunkSize)
+	require.NoError(err)
+	require.NoError(b.Close(nil))
+	m, err = readManifest(dir)
+	require.NoError(err)
+	require.Equal([]int{0, 1, 2, 3}, m.Allocated)
+}
+
+func TestOpenMultiFileDir_CrashedAllocation(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "nbd_test_volume")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	d := Descriptor{
+		Size:     2 * MinChunkSize,
+		Files:    2,
+		Geometry: Geometry{ChunkSize: MinChunkSize, Layout: LinearLayout},
+	}
+	b, err := OpenMultiFileDir(dir, d)
+	require.NoError(err)
+	_, err = b.WriteAt(nil, helloWorld, 0)
+	require.NoError(err)
+	require.NoError(b.Close(nil))
+
+	// a crash after creating a chunk file but before resizing it
+	// leaves a short chunk file that isn't in the manifest
+	name := chunkFileName(dir, 1)
+	require.NoError(ioutil.WriteFile(name, nil, 0644))
+
+	b, err = OpenMultiFileDir(dir, d)
+	require.NoError(err)
+	_, err = os.Stat(name)
+	require.True(os.IsNotExist(err))
+
+	// the chunk is allocated again when it is written to
+	_, err = b.WriteAt(nil, helloWorld, MinChunkSize)
+	require.NoError(err)
+	data, err := b.ReadAt(nil, 0, int64(helloWorldLen))
+	require.NoError(err)
+	require.Equal(helloWorld, data)
+	require.NoError(b.Close(nil))
+
+	m, err := readManifest(dir)
+	require.NoError(err)
+	require.Equal([]int{0, 1}, m.Allocated)
+	info, err := os.Stat(name)
+	require.NoError(err)
+	require.Equal(int64(MinChunkSize), info.Size())
+}
+
+func TestManifest(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "nbd_test_manifest")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, manifestName)
+
+	m := manifest{
+		Descriptor: Descriptor{
+			Version:  DescriptorVersion,
+			Size:     8 * MinChunkSize,
+			Files:    4,
+			Geometry: Geometry{ChunkSize: MinChunkSize, Layout: StripedLayout},
+		},
+		Allocated: []int{1, 3},
+	}
+	require.NoError(writeManifest(dir, m))
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	require.Contains(string(data), `"layout": "striped"`)
+
+	read, err := readManifest(dir)
+	require.NoError(err)
+	require.Equal(m, read)
+
+	// invalid manifests are neither written nor read
+	m.Version = 42
+	require.Error(writeManifest(dir, m))
+	require.NoError(ioutil.WriteFile(path, []byte(`{"version": 42}`), 0644))
+	_, err = readManifest(dir)
+	require.Error(err)
+	require.NoError(ioutil.WriteFile(path, []byte(`{"version": 1, "layout": "diagonal"}`), 0644))
+	_, err = readManifest(dir)
+	require.Error(err)
+	require.NoError(ioutil.WriteFile(path, []byte(`{"version": 1, "chunk_size": 4194304, "files": 1, "allocated": [1]}`), 0644))
+	_, err = readManifest(dir)
+	require.Error(err)
+}
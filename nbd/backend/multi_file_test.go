@@ -1,7 +1,9 @@
 package backend
 
 import (
+	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"testing"
 
@@ -22,7 +24,7 @@ func TestMultiFile(t *testing.T) {
 	files, err := generateFiles(2)
 	require.NoError(err, "Failed to generate test files")
 	defer cleanupFiles(files)
-	b := NewMultiFile(files, 4096)
+	b := NewMultiFile(files, 2*DefaultChunkSize)
 
 	// write to files through the backend and read from it again
 	for i, f := range files {
@@ -63,26 +65,266 @@ func TestMultiFile_GetFile(t *testing.T) {
 
 	// test valid file addresses
 	addr := int64(0)
-	f, err := b.getFile(addr)
+	f, _, err := b.getFile(addr)
 	require.NoError(err, "failed to get file with valid file address")
 	require.Equal(files[0].Name(), f.Name(), "file with file address 0 should return the file in the backend with index 0")
 
 	addr = int64(1) << 24 // set 4th byte to 1
-	f, err = b.getFile(addr)
+	f, _, err = b.getFile(addr)
 	require.NoError(err, "failed to get file with valid file address")
 	require.Equal(files[1].Name(), f.Name(), "file with file address 1 should return the file in the backend with index 1")
 
 	addr = int64(2) << 24
-	f, err = b.getFile(addr)
+	f, _, err = b.getFile(addr)
 	require.NoError(err, "failed to get file with valid file address")
 	require.Equal(files[2].Name(), f.Name(), "file with file address 2 should return the file in the backend with index 2")
 
 	// fetch a file that's out of range
 	addr = int64(3) << 24
-	f, err = b.getFile(addr)
+	f, _, err = b.getFile(addr)
 	require.Error(err, "this backend file should not be available")
 }
 
+func TestMultiFile_BlockStatus(t *testing.T) {
+	require := require.New(t)
+
+	files, err := generateFiles(2)
+	require.NoError(err, "Failed to generate test files")
+	defer cleanupFiles(files)
+	for _, f := range files {
+		require.NoError(f.Truncate(DefaultChunkSize))
+	}
+	b := NewMultiFile(files, 2*DefaultChunkSize)
+
+	// only the start of the second file contains data
+	data := make([]byte, 4096)
+	data[0] = 1
+	_, err = b.WriteAt(nil, data, DefaultChunkSize)
+	require.NoError(err)
+
+	extents, err := b.BlockStatus(nil, 0, 2*DefaultChunkSize)
+	require.NoError(err)
+	require.Equal([]Extent{
+		{Offset: 0, Length: DefaultChunkSize, Hole: true, Zero: true},
+		{Offset: DefaultChunkSize, Length: 4096},
+		{Offset: DefaultChunkSize + 4096, Length: DefaultChunkSize - 4096, Hole: true, Zero: true},
+	}, extents)
+
+	// ranges within a single file
+	extents, err = b.BlockStatus(nil, DefaultChunkSize+1024, 1024)
+	require.NoError(err)
+	require.Equal([]Extent{{Offset: DefaultChunkSize + 1024, Length: 1024}}, extents)
+
+	_, err = b.BlockStatus(nil, 2*DefaultChunkSize, 1)
+	require.Error(err, "ranges outside of the backend should not be available")
+}
+
+func TestMultiFile_Trim(t *testing.T) {
+	require := require.New(t)
+
+	files, err := generateFiles(2)
+	require.NoError(err, "Failed to generate test files")
+	defer cleanupFiles(files)
+	for _, f := range files {
+		require.NoError(f.Truncate(DefaultChunkSize))
+	}
+	b := NewMultiFile(files, 2*DefaultChunkSize)
+
+	// write data on both sides of the file boundary
+	data := make([]byte, 4096)
+	for i := range data {
+		data[i] = 1
+	}
+	_, err = b.WriteAt(nil, data, DefaultChunkSize-4096)
+	require.NoError(err)
+	_, err = b.WriteAt(nil, data, DefaultChunkSize)
+	require.NoError(err)
+
+	// trim a range that spans both files
+	require.NoError(b.Trim(nil, DefaultChunkSize-4096, 2*4096))
+
+	d, err := b.ReadAt(nil, DefaultChunkSize-4096, 4096)
+	require.NoError(err)
+	require.Equal(make([]byte, 4096), d)
+	d, err = b.ReadAt(nil, DefaultChunkSize, 4096)
+	require.NoError(err)
+	require.Equal(make([]byte, 4096), d)
+
+	extents, err := b.BlockStatus(nil, 0, 2*DefaultChunkSize)
+	require.NoError(err)
+	require.Equal([]Extent{{Offset: 0, Length: 2 * DefaultChunkSize, Hole: true, Zero: true}}, extents)
+}
+
+func TestMultiFile_SpanFiles(t *testing.T) {
+	require := require.New(t)
+
+	files, err := generateFiles(2)
+	require.NoError(err, "Failed to generate test files")
+	defer cleanupFiles(files)
+	for _, f := range files {
+		require.NoError(f.Truncate(DefaultChunkSize))
+	}
+	b := NewMultiFile(files, 2*DefaultChunkSize)
+
+	// a write across the file boundary continues in the next file
+	n, err := b.WriteAt(nil, helloWorld, DefaultChunkSize-5)
+	require.NoError(err)
+	require.Equal(helloWorldLen, int(n))
+
+	d := make([]byte, 5)
+	_, err = files[0].ReadAt(d, DefaultChunkSize-5)
+	require.NoError(err)
+	require.Equal(helloWorld[:5], d)
+	d = make([]byte, helloWorldLen-5)
+	_, err = files[1].ReadAt(d, 0)
+	require.NoError(err)
+	require.Equal(helloWorld[5:], d)
+
+	// and doesn't grow the first file
+	info, err := files[0].Stat()
+	require.NoError(err)
+	require.Equal(int64(DefaultChunkSize), info.Size())
+
+	// a read across the file boundary is reassembled
+	d, err = b.ReadAt(nil, DefaultChunkSize-5, int64(helloWorldLen))
+	require.NoError(err)
+	require.Equal(helloWorld, d)
+
+	// the last byte of a file is addressable
+	_, err = b.WriteAt(nil, []byte{42}, DefaultChunkSize-1)
+	require.NoError(err)
+	d = make([]byte, 1)
+	_, err = files[0].ReadAt(d, DefaultChunkSize-1)
+	require.NoError(err)
+	require.Equal([]byte{42}, d)
+
+	// writes past the last file fail
+	_, err = b.WriteAt(nil, helloWorld, 2*DefaultChunkSize-5)
+	require.Error(err)
+}
+
+func TestMultiFile_Reference(t *testing.T) {
+	geometries := []Geometry{
+		DefaultGeometry(),
+		{ChunkSize: MinChunkSize, Layout: LinearLayout},
+		{ChunkSize: MinChunkSize, Layout: StripedLayout},
+	}
+	for _, geometry := range geometries {
+		geometry := geometry
+		t.Run(fmt.Sprintf("%s-%d", geometry.Layout, geometry.ChunkSize), func(t *testing.T) {
+			testMultiFileReference(t, geometry)
+		})
+	}
+}
+
+// testMultiFileReference compares random reads and writes
+// of a multi file backend with the given geometry against a flat reference file
+func testMultiFileReference(t *testing.T, geometry Geometry) {
+	require := require.New(t)
+
+	// enough chunks to cover a few file and chunk boundaries
+	const nfiles = 3
+	size := uint64(3 * DefaultChunkSize)
+	if geometry.Layout == LinearLayout {
+		size = uint64(nfiles * geometry.ChunkSize)
+	}
+
+	files, err := generateFiles(nfiles + 1)
+	require.NoError(err, "Failed to generate test files")
+	defer cleanupFiles(files)
+	for i, f := range files[:nfiles] {
+		require.NoError(f.Truncate(geometry.FileSize(size, nfiles, i)))
+	}
+	b, err := NewMultiFileWithGeometry(files[:nfiles], size, geometry)
+	require.NoError(err)
+
+	// the backend should behave exactly like a single flat file
+	reference := files[nfiles]
+	require.NoError(reference.Truncate(int64(size)))
+
+	chunks := int64(size) / geometry.ChunkSize
+	rnd := rand.New(rand.NewSource(1))
+	randomRange := func() (int64, int64) {
+		length := rnd.Int63n(128*1024) + 1
+		var offset int64
+		if rnd.Intn(2) == 0 {
+			// ranges around a chunk boundary
+			boundary := (rnd.Int63n(chunks-1) + 1) * geometry.ChunkSize
+			offset = boundary - rnd.Int63n(length+1)
+		} else {
+			offset = rnd.Int63n(int64(size))
+		}
+		if offset+length > int64(size) {
+			length = int64(size) - offset
+		}
+		return offset, length
+	}
+
+	for i := 0; i < 500; i++ {
+		offset, length := randomRange()
+
+		if rnd.Intn(2) == 0 {
+			data := make([]byte, length)
+			rnd.Read(data)
+
+			n, err := b.WriteAt(nil, data, offset)
+			require.NoError(err)
+			require.Equal(length, n)
+			_, err = reference.WriteAt(data, offset)
+			require.NoError(err)
+			continue
+		}
+
+		d, err := b.ReadAt(nil, offset, length)
+		require.NoError(err)
+		expected := make([]byte, length)
+		_, err = reference.ReadAt(expected, offset)
+		require.NoError(err)
+		require.Equal(expected, d, "read of %d bytes at %d differs from the reference", length, offset)
+	}
+
+	// the files never grow beyond their size
+	for i, f := range files[:nfiles] {
+		info, err := f.Stat()
+		require.NoError(err)
+		require.Equal(geometry.FileSize(size, nfiles, i), info.Size())
+	}
+}
+
+func TestMultiFile_Striped(t *testing.T) {
+	require := require.New(t)
+
+	files, err := generateFiles(2)
+	require.NoError(err, "Failed to generate test files")
+	defer cleanupFiles(files)
+	geometry := Geometry{ChunkSize: MinChunkSize, Layout: StripedLayout}
+	b, err := NewMultiFileWithGeometry(files, 4*MinChunkSize, geometry)
+	require.NoError(err)
+
+	// consecutive chunks alternate between the files
+	for i := int64(0); i < 4; i++ {
+		_, err = b.WriteAt(nil, []byte{byte(i + 1)}, i*MinChunkSize)
+		require.NoError(err)
+	}
+
+	d := make([]byte, 1)
+	for i, expected := range []struct {
+		file   int
+		offset int64
+	}{{0, 0}, {1, 0}, {0, MinChunkSize}, {1, MinChunkSize}} {
+		_, err = files[expected.file].ReadAt(d, expected.offset)
+		require.NoError(err)
+		require.Equal([]byte{byte(i + 1)}, d)
+	}
+
+	require.Equal(Descriptor{
+		Version:  DescriptorVersion,
+		Size:     4 * MinChunkSize,
+		Files:    2,
+		Geometry: geometry,
+	}, b.Descriptor())
+}
+
 func generateFiles(n int) ([]*os.File, error) {
 	var files []*os.File
 	for i := 0; i < n; i++ {
@@ -0,0 +1,186 @@
+package nbd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/chrisvdg/nbdserver/nbd/backend"
+	"github.com/pkg/errors"
+)
+
+// Metadata contexts supported by the server
+const (
+	baseAllocationContext   = "base:allocation"
+	baseAllocationContextID = 1
+)
+
+// handleOptMetaContext handles NBD_OPT_LIST_META_CONTEXT and NBD_OPT_SET_META_CONTEXT
+func (c *Connection) handleOptMetaContext(opt nbdClientOpt) error {
+	if opt.NbdOptLen > maxOptionLength {
+		err := skip(c.plainconn, opt.NbdOptLen)
+		if err != nil {
+			return err
+		}
+		return c.sendOptReply(opt.NbdOptID, NBD_REP_ERR_INVALID, []byte("option data too long"))
+	}
+
+	data := make([]byte, opt.NbdOptLen)
+	_, err := io.ReadFull(c.plainconn, data)
+	if err != nil {
+		return err
+	}
+
+	set := opt.NbdOptID == NBD_OPT_SET_META_CONTEXT
+	if set && !c.structuredReplies {
+		return c.sendOptReply(opt.NbdOptID, NBD_REP_ERR_INVALID, []byte("structured replies have not been negotiated"))
+	}
+
+	name, queries, err := parseMetaContextRequest(data)
+	if err != nil {
+		return c.sendOptReply(opt.NbdOptID, NBD_REP_ERR_INVALID, []byte(err.Error()))
+	}
+
+	export, ok := c.server.Exports.Get(name)
+	if !ok {
+		return c.sendOptReply(opt.NbdOptID, NBD_REP_ERR_UNKNOWN, []byte("unknown export"))
+	}
+	if c.access(export) == AccessDenied {
+		return c.sendOptReply(opt.NbdOptID, NBD_REP_ERR_POLICY, []byte("access to export denied"))
+	}
+
+	// listing without queries returns all contexts,
+	// a query for the whole base namespace is only valid when listing
+	selected := false
+	for _, query := range queries {
+		if query == baseAllocationContext || (!set && query == "base:") {
+			selected = true
+		}
+	}
+	if !set && len(queries) == 0 {
+		selected = true
+	}
+
+	if set {
+		c.baseAllocation = selected
+		c.metaContextExport = export.Name
+	}
+
+	if selected {
+		// contexts are not given an ID when listing them
+		var id uint32
+		if set {
+			id = baseAllocationContextID
+		}
+
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.BigEndian, id)
+		buf.WriteString(baseAllocationContext)
+		err = c.sendOptReply(opt.NbdOptID, NBD_REP_META_CONTEXT, buf.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.sendOptReply(opt.NbdOptID, NBD_REP_ACK, nil)
+}
+
+// parseMetaContextRequest parses the data of an NBD_OPT_LIST_META_CONTEXT
+// or NBD_OPT_SET_META_CONTEXT option into the export name and the queries
+func parseMetaContextRequest(data []byte) (string, []string, error) {
+	name, data, err := readString(data)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "invalid export name")
+	}
+
+	if len(data) < 4 {
+		return "", nil, errors.New("missing number of queries")
+	}
+	n := binary.BigEndian.Uint32(data)
+	data = data[4:]
+
+	var queries []string
+	for i := uint32(0); i < n; i++ {
+		var query string
+		query, data, err = readString(data)
+		if err != nil {
+			return "", nil, errors.Wrap(err, "invalid query")
+		}
+		queries = append(queries, query)
+	}
+	if len(data) != 0 {
+		return "", nil, errors.New("query count does not match option length")
+	}
+
+	return name, queries, nil
+}
+
+// readString reads a string prefixed by its 32 bit length
+// and returns the string and the remaining data
+func readString(data []byte) (string, []byte, error) {
+	if len(data) < 4 {
+		return "", nil, errors.New("missing string length")
+	}
+	n := binary.BigEndian.Uint32(data)
+	data = data[4:]
+	if uint64(n) > uint64(len(data)) {
+		return "", nil, errors.New("string length exceeds option length")
+	}
+
+	return string(data[:n]), data[n:], nil
+}
+
+// handleBlockStatus handles NBD_CMD_BLOCK_STATUS
+// for the base:allocation metadata context
+func (c *Connection) handleBlockStatus(req nbdRequest) {
+	if !c.structuredReplies || !c.baseAllocation {
+		c.sendError(req, NBD_EINVAL, "no metadata context was selected")
+		return
+	}
+
+	extents, err := c.blockStatus(int64(req.NbdOffset), int64(req.NbdLength))
+	if err != nil {
+		fmt.Printf("Something went wrong getting the block status from the backend: %v\n", err)
+		c.sendErrorOffsetChunk(req.NbdHandle, NBD_EIO, err.Error(), req.NbdOffset)
+		return
+	}
+	if req.NbdCommandFlags&NBD_CMD_FLAG_REQ_ONE != 0 {
+		extents = extents[:1]
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(baseAllocationContextID))
+	for _, e := range extents {
+		var flags uint32
+		if e.Hole {
+			flags |= NBD_STATE_HOLE
+		}
+		if e.Zero {
+			flags |= NBD_STATE_ZERO
+		}
+		binary.Write(&buf, binary.BigEndian, uint32(e.Length))
+		binary.Write(&buf, binary.BigEndian, flags)
+	}
+
+	c.sendChunk(req.NbdHandle, NBD_REPLY_FLAG_DONE, NBD_REPLY_TYPE_BLOCK_STATUS, buf.Bytes())
+}
+
+// blockStatus returns the extents of the given range,
+// the whole range is reported as data when the backend can't tell
+func (c *Connection) blockStatus(offset, length int64) ([]backend.Extent, error) {
+	bs, ok := c.backend.(backend.BlockStatuser)
+	if !ok {
+		return []backend.Extent{{Offset: offset, Length: length}}, nil
+	}
+
+	extents, err := bs.BlockStatus(nil, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	if len(extents) == 0 {
+		return nil, errors.New("backend returned no extents")
+	}
+
+	return extents, nil
+}
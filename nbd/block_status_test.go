@@ -0,0 +1,95 @@
+package nbd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockStatus(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+	_, err := export.Backend.WriteAt(nil, []byte("Hello world!"), 2*preferredBlockSize)
+	require.NoError(err)
+
+	client, result := startNegotiation(t, newTestServer(t, export))
+	defer client.Close()
+
+	// listing returns the context without an ID
+	sendMetaContextOpt(t, client, NBD_OPT_LIST_META_CONTEXT, "vdisk")
+	replyType, data := readOptReply(t, client, NBD_OPT_LIST_META_CONTEXT)
+	require.Equal(NBD_REP_META_CONTEXT, replyType)
+	require.Equal(uint32(0), binary.BigEndian.Uint32(data))
+	require.Equal(baseAllocationContext, string(data[4:]))
+	replyType, _ = readOptReply(t, client, NBD_OPT_LIST_META_CONTEXT)
+	require.Equal(NBD_REP_ACK, replyType)
+
+	// contexts can only be selected with structured replies
+	sendMetaContextOpt(t, client, NBD_OPT_SET_META_CONTEXT, "vdisk", baseAllocationContext)
+	replyType, _ = readOptReply(t, client, NBD_OPT_SET_META_CONTEXT)
+	require.Equal(NBD_REP_ERR_INVALID, replyType)
+
+	sendOpt(t, client, NBD_OPT_STRUCTURED_REPLY, nil)
+	replyType, _ = readOptReply(t, client, NBD_OPT_STRUCTURED_REPLY)
+	require.Equal(NBD_REP_ACK, replyType)
+
+	sendMetaContextOpt(t, client, NBD_OPT_SET_META_CONTEXT, "vdisk", "unknown:context", baseAllocationContext)
+	replyType, data = readOptReply(t, client, NBD_OPT_SET_META_CONTEXT)
+	require.Equal(NBD_REP_META_CONTEXT, replyType)
+	require.Equal(uint32(baseAllocationContextID), binary.BigEndian.Uint32(data))
+	require.Equal(baseAllocationContext, string(data[4:]))
+	replyType, _ = readOptReply(t, client, NBD_OPT_SET_META_CONTEXT)
+	require.Equal(NBD_REP_ACK, replyType)
+
+	sendInfoOpt(t, client, NBD_OPT_GO, "vdisk")
+	replyType, _ = readOptReply(t, client, NBD_OPT_GO)
+	require.Equal(NBD_REP_INFO, replyType)
+	replyType, _ = readOptReply(t, client, NBD_OPT_GO)
+	require.Equal(NBD_REP_ACK, replyType)
+	require.NoError((<-result).err)
+
+	sendRequest(t, client, NBD_CMD_BLOCK_STATUS, 0, 1, 0, testExportSize)
+	chunk, payload := readChunk(t, client, 1)
+	require.Equal(uint16(NBD_REPLY_TYPE_BLOCK_STATUS), chunk.NbdType)
+	require.Equal(uint16(NBD_REPLY_FLAG_DONE), chunk.NbdFlags)
+	require.Equal(uint32(baseAllocationContextID), binary.BigEndian.Uint32(payload))
+
+	// the written block is allocated, the rest of the sparse file is not
+	var descriptors []struct{ Length, Flags uint32 }
+	var total uint32
+	r := bytes.NewReader(payload[4:])
+	for r.Len() > 0 {
+		var d struct{ Length, Flags uint32 }
+		require.NoError(binary.Read(r, binary.BigEndian, &d))
+		descriptors = append(descriptors, d)
+		total += d.Length
+	}
+	require.Equal(uint32(testExportSize), total)
+	require.True(len(descriptors) >= 2)
+	require.Equal(NBD_STATE_HOLE|NBD_STATE_ZERO, descriptors[0].Flags)
+	require.Equal(uint32(0), descriptors[1].Flags)
+
+	// only the first extent is returned when requested
+	sendRequest(t, client, NBD_CMD_BLOCK_STATUS, NBD_CMD_FLAG_REQ_ONE, 2, 0, testExportSize)
+	_, payload = readChunk(t, client, 2)
+	require.Len(payload, 12)
+}
+
+// sendMetaContextOpt sends an NBD_OPT_LIST_META_CONTEXT or NBD_OPT_SET_META_CONTEXT option
+func sendMetaContextOpt(t *testing.T, w io.Writer, optID uint32, name string, queries ...string) {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(len(name)))
+	buf.WriteString(name)
+	binary.Write(&buf, binary.BigEndian, uint32(len(queries)))
+	for _, query := range queries {
+		binary.Write(&buf, binary.BigEndian, uint32(len(query)))
+		buf.WriteString(query)
+	}
+
+	sendOpt(t, w, optID, buf.Bytes())
+}
@@ -0,0 +1,779 @@
+package nbd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ErrClientClosed is returned for requests on a closed client
+var ErrClientClosed = errors.New("nbd client is closed")
+
+// maxTrimLength is the largest block aligned length of a single trim request
+const maxTrimLength = math.MaxUint32 &^ (preferredBlockSize - 1)
+
+// OptionError is returned when the server refused an option during the negotiation
+type OptionError struct {
+	Option    uint32
+	ReplyType uint32
+	Message   string
+}
+
+func (e *OptionError) Error() string {
+	return fmt.Sprintf("server refused option %d with reply %#x: %s", e.Option, e.ReplyType, e.Message)
+}
+
+// RequestError is returned when the server replied to a request with an error
+type RequestError struct {
+	Errno   uint32
+	Message string
+}
+
+func (e *RequestError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("server replied with error %d", e.Errno)
+	}
+	return fmt.Sprintf("server replied with error %d: %s", e.Errno, e.Message)
+}
+
+// ExportListing describes an export listed by a server
+type ExportListing struct {
+	Name        string
+	Description string
+}
+
+// Dial connects to the NBD server at the given TCP address
+// and opens the export with the given name,
+// the default export of the server is opened when the name is empty
+func Dial(address, export string) (*Client, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := NewClient(conn, export)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// NewClient executes a fixed-newstyle negotiation over the given connection
+// and opens the export with the given name.
+// The client owns the connection once the negotiation succeeded.
+func NewClient(conn net.Conn, export string) (*Client, error) {
+	noZeroes, err := clientHandshake(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		conn:       conn,
+		name:       export,
+		maxRequest: maximumBlockSize,
+		pending:    make(map[uint64]*clientRequest),
+		done:       make(chan struct{}),
+	}
+
+	// structured replies are optional
+	err = sendClientOpt(conn, NBD_OPT_STRUCTURED_REPLY, nil)
+	if err != nil {
+		return nil, err
+	}
+	replyType, _, err := readClientOptReply(conn, NBD_OPT_STRUCTURED_REPLY)
+	if err != nil {
+		return nil, err
+	}
+	c.structuredReplies = replyType == NBD_REP_ACK
+
+	err = c.optGo()
+	if optErr, ok := errors.Cause(err).(*OptionError); ok && optErr.ReplyType == NBD_REP_ERR_UNSUP {
+		// servers that don't support NBD_OPT_GO can't send structured replies either
+		c.structuredReplies = false
+		err = c.optExportName(noZeroes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	go c.readReplies()
+
+	return c, nil
+}
+
+// ListExports executes a fixed-newstyle negotiation over the given connection
+// and lists the exports of the server,
+// the negotiation is aborted afterwards
+func ListExports(conn io.ReadWriter) ([]ExportListing, error) {
+	_, err := clientHandshake(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	err = sendClientOpt(conn, NBD_OPT_LIST, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var exports []ExportListing
+	for {
+		replyType, data, err := readClientOptReply(conn, NBD_OPT_LIST)
+		if err != nil {
+			return nil, err
+		}
+		if replyType == NBD_REP_ACK {
+			break
+		}
+		if replyType&NBD_REP_FLAG_ERROR != 0 {
+			return nil, &OptionError{Option: NBD_OPT_LIST, ReplyType: replyType, Message: string(data)}
+		}
+		if replyType != NBD_REP_SERVER {
+			continue
+		}
+
+		name, description, err := readString(data)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid export listing")
+		}
+		exports = append(exports, ExportListing{Name: name, Description: string(description)})
+	}
+
+	// the server may close the connection without replying to the abort
+	err = sendClientOpt(conn, NBD_OPT_ABORT, nil)
+	if err != nil {
+		return nil, err
+	}
+	readClientOptReply(conn, NBD_OPT_ABORT)
+
+	return exports, nil
+}
+
+// Client represents the client side of an NBD connection
+// in the transmission phase.
+// Its methods can be called concurrently,
+// in which case the requests are in flight at the same time.
+type Client struct {
+	conn              net.Conn
+	name              string
+	size              uint64
+	flags             uint16
+	maxRequest        uint32
+	structuredReplies bool
+
+	// serializes writing requests
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	handle  uint64
+	pending map[uint64]*clientRequest
+	// set once the connection failed or the client was closed
+	err error
+	// tracks the requests that have not been replied to yet
+	inFlight sync.WaitGroup
+
+	// closed once the replies are no longer read
+	done chan struct{}
+}
+
+// clientRequest is a request that is waiting for its reply
+type clientRequest struct {
+	offset uint64
+	// buffer that receives the data of a read
+	buf []byte
+	// number of bytes of buf covered by data and hole chunks
+	covered uint64
+	err     error
+	done    chan struct{}
+}
+
+var (
+	_ io.ReaderAt = (*Client)(nil)
+	_ io.WriterAt = (*Client)(nil)
+)
+
+// Size returns the size of the export
+func (c *Client) Size() uint64 {
+	return c.size
+}
+
+// Flags returns the transmission flags of the export
+func (c *Client) Flags() uint16 {
+	return c.flags
+}
+
+// ReadOnly returns whether the export is read-only
+func (c *Client) ReadOnly() bool {
+	return c.flags&NBD_FLAG_READ_ONLY != 0
+}
+
+// ReadAt reads len(p) bytes from the export at the given offset,
+// io.EOF is returned when the read exceeds the size of the export
+func (c *Client) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if uint64(off) >= c.size {
+		return 0, io.EOF
+	}
+
+	eof := false
+	if remaining := c.size - uint64(off); uint64(len(p)) > remaining {
+		p = p[:remaining]
+		eof = true
+	}
+
+	n := 0
+	for n < len(p) {
+		chunk := p[n:]
+		if len(chunk) > int(c.maxRequest) {
+			chunk = chunk[:c.maxRequest]
+		}
+
+		err := c.do(NBD_CMD_READ, 0, uint64(off)+uint64(n), uint32(len(chunk)), nil, chunk)
+		if err != nil {
+			return n, err
+		}
+		n += len(chunk)
+	}
+
+	if eof {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt writes len(p) bytes to the export at the given offset
+func (c *Client) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if c.ReadOnly() {
+		return 0, errors.New("export is read-only")
+	}
+	if uint64(off) > c.size || uint64(len(p)) > c.size-uint64(off) {
+		return 0, errors.New("write exceeds the size of the export")
+	}
+
+	n := 0
+	for n < len(p) {
+		chunk := p[n:]
+		if len(chunk) > int(c.maxRequest) {
+			chunk = chunk[:c.maxRequest]
+		}
+
+		err := c.do(NBD_CMD_WRITE, 0, uint64(off)+uint64(n), uint32(len(chunk)), chunk, nil)
+		if err != nil {
+			return n, err
+		}
+		n += len(chunk)
+	}
+
+	return n, nil
+}
+
+// Flush forces all completed writes to stable storage
+func (c *Client) Flush() error {
+	if c.flags&NBD_FLAG_SEND_FLUSH == 0 {
+		return errors.New("export does not support flushing")
+	}
+
+	return c.do(NBD_CMD_FLUSH, 0, 0, 0, nil, nil)
+}
+
+// Trim discards the given range of the export
+func (c *Client) Trim(offset, length int64) error {
+	if offset < 0 || length < 0 {
+		return errors.New("negative offset or length")
+	}
+	if c.flags&NBD_FLAG_SEND_TRIM == 0 {
+		return errors.New("export does not support trimming")
+	}
+
+	for length > 0 {
+		n := length
+		if n > maxTrimLength {
+			n = maxTrimLength
+		}
+
+		err := c.do(NBD_CMD_TRIM, 0, uint64(offset), uint32(n), nil, nil)
+		if err != nil {
+			return err
+		}
+		offset += n
+		length -= n
+	}
+
+	return nil
+}
+
+// Close waits for the requests in flight,
+// disconnects from the server and closes the connection
+func (c *Client) Close() error {
+	c.mu.Lock()
+	failed := c.err
+	if failed == nil {
+		c.err = ErrClientClosed
+	}
+	c.mu.Unlock()
+
+	if failed == ErrClientClosed {
+		return ErrClientClosed
+	}
+
+	// the connection is already broken when the client failed
+	if failed == nil {
+		c.inFlight.Wait()
+
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.BigEndian, nbdRequest{
+			NbdRequestMagic: NBD_REQUEST_MAGIC,
+			NbdCommandType:  NBD_CMD_DISC,
+		})
+		c.writeMu.Lock()
+		c.conn.Write(buf.Bytes())
+		c.writeMu.Unlock()
+	}
+
+	err := c.conn.Close()
+	<-c.done
+
+	return err
+}
+
+// broken returns whether the connection of the client failed
+func (c *Client) broken() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err != nil && c.err != ErrClientClosed
+}
+
+// do sends a request and waits for its reply,
+// the data of a read is stored in buf
+func (c *Client) do(cmd, flags uint16, offset uint64, length uint32, payload, buf []byte) error {
+	req := &clientRequest{
+		offset: offset,
+		buf:    buf,
+		done:   make(chan struct{}),
+	}
+
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		return err
+	}
+	c.handle++
+	handle := c.handle
+	c.pending[handle] = req
+	c.inFlight.Add(1)
+	c.mu.Unlock()
+	defer c.inFlight.Done()
+
+	var hdr bytes.Buffer
+	binary.Write(&hdr, binary.BigEndian, nbdRequest{
+		NbdRequestMagic: NBD_REQUEST_MAGIC,
+		NbdCommandFlags: flags,
+		NbdCommandType:  cmd,
+		NbdHandle:       handle,
+		NbdOffset:       offset,
+		NbdLength:       length,
+	})
+
+	c.writeMu.Lock()
+	_, err := c.conn.Write(hdr.Bytes())
+	if err == nil && len(payload) > 0 {
+		_, err = c.conn.Write(payload)
+	}
+	c.writeMu.Unlock()
+	if err != nil {
+		// the request is failed once the replies are no longer read
+		c.fail(errors.Wrap(err, "something went wrong sending a request"))
+	}
+
+	<-req.done
+	return req.err
+}
+
+// fail marks the client as failed and closes its connection
+func (c *Client) fail(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+
+	c.conn.Close()
+}
+
+// readReplies reads replies until the connection fails or is closed,
+// the requests that did not receive a reply are failed afterwards
+func (c *Client) readReplies() {
+	defer close(c.done)
+
+	err := c.readReplyLoop()
+
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	err = c.err
+	pending := c.pending
+	c.pending = nil
+	c.mu.Unlock()
+
+	c.conn.Close()
+	for _, req := range pending {
+		req.err = err
+		close(req.done)
+	}
+}
+
+// readReplyLoop reads simple replies and structured reply chunks
+// and completes the requests they belong to
+func (c *Client) readReplyLoop() error {
+	for {
+		var magic uint32
+		err := binary.Read(c.conn, binary.BigEndian, &magic)
+		if err != nil {
+			return errors.Wrap(err, "something went wrong reading a reply")
+		}
+
+		switch magic {
+		case NBD_REPLY_MAGIC:
+			err = c.readSimpleReply()
+		case NBD_STRUCTURED_REPLY_MAGIC:
+			if !c.structuredReplies {
+				return errors.New("server sent a structured reply that was not negotiated")
+			}
+			err = c.readChunk()
+		default:
+			return errors.New("server had bad magic number in reply")
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readSimpleReply reads the remainder of a simple reply
+func (c *Client) readSimpleReply() error {
+	var rest struct {
+		NbdError  uint32
+		NbdHandle uint64
+	}
+	err := binary.Read(c.conn, binary.BigEndian, &rest)
+	if err != nil {
+		return errors.Wrap(err, "something went wrong reading a reply")
+	}
+
+	req, err := c.takeRequest(rest.NbdHandle)
+	if err != nil {
+		return err
+	}
+	defer close(req.done)
+
+	if rest.NbdError != 0 {
+		req.err = &RequestError{Errno: rest.NbdError}
+		return nil
+	}
+
+	// the data of a read can't follow a simple reply when structured replies were negotiated,
+	// so the connection can't be used anymore
+	if req.buf != nil && c.structuredReplies {
+		req.err = errors.New("server sent a simple reply to a structured read")
+		return req.err
+	}
+
+	// read data is only sent in chunks when structured replies were negotiated
+	if req.buf != nil && !c.structuredReplies {
+		_, err = io.ReadFull(c.conn, req.buf)
+		if err != nil {
+			req.err = errors.Wrap(err, "something went wrong reading the data of a reply")
+			return req.err
+		}
+	}
+
+	return nil
+}
+
+// readChunk reads the remainder of a structured reply chunk
+func (c *Client) readChunk() error {
+	var rest struct {
+		NbdFlags  uint16
+		NbdType   uint16
+		NbdHandle uint64
+		NbdLength uint32
+	}
+	err := binary.Read(c.conn, binary.BigEndian, &rest)
+	if err != nil {
+		return errors.Wrap(err, "something went wrong reading a reply chunk")
+	}
+	if rest.NbdLength > c.maxRequest+8+maxErrorMessageLength {
+		return errors.New("server sent a reply chunk that is too long")
+	}
+
+	payload := make([]byte, rest.NbdLength)
+	_, err = io.ReadFull(c.conn, payload)
+	if err != nil {
+		return errors.Wrap(err, "something went wrong reading a reply chunk")
+	}
+
+	c.mu.Lock()
+	req, ok := c.pending[rest.NbdHandle]
+	c.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("server replied to unknown handle %d", rest.NbdHandle)
+	}
+
+	err = c.applyChunk(req, rest.NbdType, payload)
+	if err != nil && req.err == nil {
+		req.err = err
+	}
+
+	if rest.NbdFlags&NBD_REPLY_FLAG_DONE != 0 {
+		_, err = c.takeRequest(rest.NbdHandle)
+		if err != nil {
+			return err
+		}
+		// chunks don't overlap, so a successful read is covered exactly
+		if req.err == nil && req.covered != uint64(len(req.buf)) {
+			req.err = fmt.Errorf("reply chunks covered %d of the %d bytes that were read", req.covered, len(req.buf))
+		}
+		close(req.done)
+	}
+
+	return nil
+}
+
+// applyChunk applies the payload of a reply chunk to its request
+func (c *Client) applyChunk(req *clientRequest, replyType uint16, payload []byte) error {
+	switch replyType {
+	case NBD_REPLY_TYPE_NONE:
+		return nil
+	case NBD_REPLY_TYPE_OFFSET_DATA:
+		if len(payload) < 8 {
+			return errors.New("data chunk is too short")
+		}
+		buf, err := req.slice(binary.BigEndian.Uint64(payload), uint64(len(payload)-8))
+		if err != nil {
+			return err
+		}
+		copy(buf, payload[8:])
+		req.covered += uint64(len(buf))
+	case NBD_REPLY_TYPE_OFFSET_HOLE:
+		if len(payload) != 12 {
+			return errors.New("invalid hole chunk")
+		}
+		buf, err := req.slice(binary.BigEndian.Uint64(payload), uint64(binary.BigEndian.Uint32(payload[8:])))
+		if err != nil {
+			return err
+		}
+		for i := range buf {
+			buf[i] = 0
+		}
+		req.covered += uint64(len(buf))
+	case NBD_REPLY_TYPE_ERROR, NBD_REPLY_TYPE_ERROR_OFFSET:
+		if len(payload) < 6 {
+			return errors.New("error chunk is too short")
+		}
+		errno := binary.BigEndian.Uint32(payload)
+		msgLen := int(binary.BigEndian.Uint16(payload[4:]))
+		if 6+msgLen > len(payload) {
+			return &RequestError{Errno: errno}
+		}
+		return &RequestError{Errno: errno, Message: string(payload[6 : 6+msgLen])}
+	default:
+		// unknown chunk types can only be ignored when they are not errors
+		if replyType&(1<<15) != 0 {
+			return fmt.Errorf("server replied with unknown error chunk %d", replyType)
+		}
+	}
+
+	return nil
+}
+
+// slice returns the part of the read buffer of a request
+// that holds the given range of the export
+func (req *clientRequest) slice(offset, length uint64) ([]byte, error) {
+	if offset < req.offset || offset-req.offset > uint64(len(req.buf)) ||
+		length > uint64(len(req.buf))-(offset-req.offset) {
+		return nil, errors.New("reply chunk exceeds the requested range")
+	}
+
+	start := offset - req.offset
+	return req.buf[start : start+length], nil
+}
+
+// takeRequest removes the request with the given handle from the pending requests
+func (c *Client) takeRequest(handle uint64) (*clientRequest, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	req, ok := c.pending[handle]
+	if !ok {
+		return nil, fmt.Errorf("server replied to unknown handle %d", handle)
+	}
+	delete(c.pending, handle)
+
+	return req, nil
+}
+
+// optGo opens the export of the client with NBD_OPT_GO
+func (c *Client) optGo() error {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(len(c.name)))
+	buf.WriteString(c.name)
+	binary.Write(&buf, binary.BigEndian, uint16(1))
+	binary.Write(&buf, binary.BigEndian, uint16(NBD_INFO_BLOCK_SIZE))
+
+	err := sendClientOpt(c.conn, NBD_OPT_GO, buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	gotExport := false
+	for {
+		replyType, data, err := readClientOptReply(c.conn, NBD_OPT_GO)
+		if err != nil {
+			return err
+		}
+		if replyType&NBD_REP_FLAG_ERROR != 0 {
+			return &OptionError{Option: NBD_OPT_GO, ReplyType: replyType, Message: string(data)}
+		}
+
+		switch replyType {
+		case NBD_REP_ACK:
+			if !gotExport {
+				return errors.New("server did not send the export information")
+			}
+			return nil
+		case NBD_REP_INFO:
+			if len(data) < 2 {
+				return errors.New("server sent invalid export information")
+			}
+			switch binary.BigEndian.Uint16(data) {
+			case NBD_INFO_EXPORT:
+				var info nbdInfoExport
+				err = binary.Read(bytes.NewReader(data), binary.BigEndian, &info)
+				if err != nil {
+					return errors.Wrap(err, "server sent invalid export information")
+				}
+				c.size = info.NbdExportSize
+				c.flags = info.NbdTransmissionFlags
+				gotExport = true
+			case NBD_INFO_BLOCK_SIZE:
+				var info nbdInfoBlockSize
+				err = binary.Read(bytes.NewReader(data), binary.BigEndian, &info)
+				if err != nil {
+					return errors.Wrap(err, "server sent invalid block size information")
+				}
+				if info.NbdMaximumBlockSize != 0 && info.NbdMaximumBlockSize < c.maxRequest {
+					c.maxRequest = info.NbdMaximumBlockSize
+				}
+			}
+		}
+	}
+}
+
+// optExportName opens the export of the client with NBD_OPT_EXPORT_NAME,
+// which the server can only refuse by closing the connection
+func (c *Client) optExportName(noZeroes bool) error {
+	err := sendClientOpt(c.conn, NBD_OPT_EXPORT_NAME, []byte(c.name))
+	if err != nil {
+		return err
+	}
+
+	var ed nbdExportDetails
+	err = binary.Read(c.conn, binary.BigEndian, &ed)
+	if err != nil {
+		return errors.Wrap(err, "server refused the export")
+	}
+	if !noZeroes {
+		err = skip(c.conn, 124)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.size = ed.NbdExportSize
+	c.flags = ed.NbdExportFlags
+	return nil
+}
+
+// clientHandshake reads the fixed-newstyle header of the server
+// and replies with the client flags,
+// it returns whether the zeroes after the export details are omitted
+func clientHandshake(conn io.ReadWriter) (bool, error) {
+	var nsh nbdNewStyleHeader
+	err := binary.Read(conn, binary.BigEndian, &nsh)
+	if err != nil {
+		return false, errors.Wrap(err, "something went wrong reading the server header")
+	}
+	if nsh.NbdMagic != NBD_MAGIC || nsh.NbdOptsMagic != NBD_OPTS_MAGIC {
+		return false, errors.New("server does not support newstyle negotiation")
+	}
+	if nsh.NbdGlobalFlags&NBD_FLAG_FIXED_NEWSTYLE == 0 {
+		return false, errors.New("server does not support fixed-newstyle negotiation")
+	}
+
+	clf := nbdClientFlags{NbdClientFlags: NBD_FLAG_C_FIXED_NEWSTYLE}
+	noZeroes := nsh.NbdGlobalFlags&NBD_FLAG_NO_ZEROES != 0
+	if noZeroes {
+		clf.NbdClientFlags |= NBD_FLAG_C_NO_ZEROES
+	}
+
+	return noZeroes, binary.Write(conn, binary.BigEndian, clf)
+}
+
+// sendClientOpt sends an option with the given data
+func sendClientOpt(w io.Writer, optID uint32, data []byte) error {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, nbdClientOpt{
+		NbdOptMagic: NBD_OPTS_MAGIC,
+		NbdOptID:    optID,
+		NbdOptLen:   uint32(len(data)),
+	})
+	buf.Write(data)
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// readClientOptReply reads the reply to the given option
+// and returns its type and data
+func readClientOptReply(r io.Reader, optID uint32) (uint32, []byte, error) {
+	var or nbdOptReply
+	err := binary.Read(r, binary.BigEndian, &or)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "something went wrong reading an option reply")
+	}
+	if or.NbdOptReplyMagic != NBD_REP_MAGIC {
+		return 0, nil, errors.New("server had bad magic number in option reply")
+	}
+	if or.NbdOptID != optID {
+		return 0, nil, fmt.Errorf("server replied to option %d instead of %d", or.NbdOptID, optID)
+	}
+	if or.NbdOptReplyLength > maxOptReplyLength {
+		return 0, nil, errors.New("option reply is too long")
+	}
+
+	data := make([]byte, or.NbdOptReplyLength)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "something went wrong reading an option reply")
+	}
+
+	return or.NbdOptReplyType, data, nil
+}
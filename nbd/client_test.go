@@ -0,0 +1,224 @@
+package nbd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient_ReadWrite(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+
+	client, result := startClient(t, newTestServer(t, export), "vdisk")
+	require.Equal(uint64(testExportSize), client.Size())
+	require.False(client.ReadOnly())
+
+	data := bytes.Repeat([]byte{1, 2, 3, 4}, 1024)
+	n, err := client.WriteAt(data, 4096)
+	require.NoError(err)
+	require.Equal(len(data), n)
+	require.NoError(client.Flush())
+
+	// the written data is surrounded by holes
+	buf := make([]byte, 3*4096)
+	for i := range buf {
+		buf[i] = 0xff
+	}
+	n, err = client.ReadAt(buf, 0)
+	require.NoError(err)
+	require.Equal(len(buf), n)
+	require.Equal(make([]byte, 4096), buf[:4096])
+	require.Equal(data, buf[4096:8192])
+	require.Equal(make([]byte, 4096), buf[8192:])
+
+	// reads past the end of the export are short
+	n, err = client.ReadAt(buf, testExportSize-10)
+	require.Equal(io.EOF, err)
+	require.Equal(10, n)
+
+	_, err = client.WriteAt(data, testExportSize-10)
+	require.Error(err)
+
+	require.NoError(client.Trim(4096, 4096))
+
+	require.NoError(client.Close())
+	require.Equal(ErrClientClosed, client.Close())
+	_, err = client.ReadAt(buf, 0)
+	require.Equal(ErrClientClosed, err)
+
+	res := <-result
+	require.NoError(res.err)
+	require.True(res.handled)
+}
+
+func TestClient_Concurrent(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+
+	client, result := startClient(t, newTestServer(t, export), "vdisk")
+
+	errs := make(chan error, 32)
+	for i := 0; i < 32; i++ {
+		go func(i int) {
+			data := bytes.Repeat([]byte{byte(i + 1)}, 512)
+			_, err := client.WriteAt(data, int64(i)*512)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			buf := make([]byte, 512)
+			_, err = client.ReadAt(buf, int64(i)*512)
+			if err == nil && !bytes.Equal(data, buf) {
+				err = fmt.Errorf("read %v at %d, expected %v", buf[:4], i*512, data[:4])
+			}
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < 32; i++ {
+		require.NoError(<-errs)
+	}
+
+	require.NoError(client.Close())
+	require.NoError((<-result).err)
+}
+
+func TestClient_ReadOnly(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+	export.ReadOnly = true
+
+	client, _ := startClient(t, newTestServer(t, export), "vdisk")
+	defer client.Close()
+
+	require.True(client.ReadOnly())
+	_, err := client.WriteAt([]byte{1}, 0)
+	require.Error(err)
+	require.Error(client.Flush())
+	require.Error(client.Trim(0, 1))
+}
+
+func TestClient_UnknownExport(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+
+	client, plainconn := net.Pipe()
+	defer client.Close()
+	serveConn(t, newTestServer(t, export), plainconn)
+
+	_, err := NewClient(client, "unknown")
+	require.Error(err)
+	optErr, ok := err.(*OptionError)
+	require.True(ok)
+	require.Equal(NBD_REP_ERR_UNKNOWN, optErr.ReplyType)
+}
+
+func TestListExports(t *testing.T) {
+	require := require.New(t)
+
+	first, cleanup := newTestExport(t, "first")
+	defer cleanup()
+	first.Description = "first disk"
+	second, cleanup := newTestExport(t, "second")
+	defer cleanup()
+
+	client, plainconn := net.Pipe()
+	defer client.Close()
+	result := serveConn(t, newTestServer(t, first, second), plainconn)
+
+	exports, err := ListExports(client)
+	require.NoError(err)
+	require.Equal([]ExportListing{
+		{Name: "first", Description: "first disk"},
+		{Name: "second"},
+	}, exports)
+
+	// the server ends the negotiation after the abort
+	require.Error((<-result).err)
+}
+
+func TestClient_IncompleteRead(t *testing.T) {
+	require := require.New(t)
+
+	conn, server := net.Pipe()
+	client := &Client{
+		conn:              conn,
+		size:              testExportSize,
+		maxRequest:        maximumBlockSize,
+		structuredReplies: true,
+		pending:           make(map[uint64]*clientRequest),
+		done:              make(chan struct{}),
+	}
+	go client.readReplies()
+	defer client.Close()
+	defer server.Close()
+
+	// the server only sends the first half of the data before it is done
+	go func() {
+		var req nbdRequest
+		if binary.Read(server, binary.BigEndian, &req) != nil {
+			return
+		}
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.BigEndian, nbdStructuredReply{
+			NbdStructuredReplyMagic: NBD_STRUCTURED_REPLY_MAGIC,
+			NbdFlags:                NBD_REPLY_FLAG_DONE,
+			NbdType:                 NBD_REPLY_TYPE_OFFSET_DATA,
+			NbdHandle:               req.NbdHandle,
+			NbdLength:               8 + req.NbdLength/2,
+		})
+		binary.Write(&buf, binary.BigEndian, req.NbdOffset)
+		buf.Write(make([]byte, req.NbdLength/2))
+		server.Write(buf.Bytes())
+	}()
+
+	p := bytes.Repeat([]byte{0xff}, 1024)
+	_, err := client.ReadAt(p, 0)
+	require.Error(err)
+	require.Contains(err.Error(), "covered 512 of the 1024 bytes")
+}
+
+// startClient returns a client for the export with the given name
+func startClient(t *testing.T, server *Server, name string) (*Client, <-chan negotiationResult) {
+	client, plainconn := net.Pipe()
+	result := serveConn(t, server, plainconn)
+
+	c, err := NewClient(client, name)
+	require.NoError(t, err)
+	require.NoError(t, (<-result).err)
+
+	return c, result
+}
+
+// serveConn negotiates and handles the requests of the server side of a connection
+func serveConn(t *testing.T, server *Server, plainconn net.Conn) <-chan negotiationResult {
+	conn, err := NewConn(plainconn, server)
+	require.NoError(t, err)
+
+	result := make(chan negotiationResult, 2)
+	go func() {
+		defer conn.Close()
+		name, err := conn.Negotiate()
+		result <- negotiationResult{name: name, err: err}
+		if err == nil {
+			err = conn.HandleRequests()
+			result <- negotiationResult{name: name, err: err, handled: true}
+		}
+	}()
+
+	return result
+}
@@ -1,20 +1,25 @@
 package nbd
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/chrisvdg/nbdserver/nbd/backend"
 	"github.com/pkg/errors"
 )
 
 // NewConn returns a new Connection
-func NewConn(plainconn net.Conn, backend backend.Backend) (*Connection, error) {
+// that serves the exports of the given server
+func NewConn(plainconn net.Conn, server *Server) (*Connection, error) {
 	conn := &Connection{
 		plainconn: plainconn,
-		backend:   backend,
+		rawconn:   plainconn,
+		server:    server,
 	}
 
 	return conn, nil
@@ -23,92 +28,45 @@ func NewConn(plainconn net.Conn, backend backend.Backend) (*Connection, error) {
 // Connection represents an NBD connection
 type Connection struct {
 	plainconn net.Conn
-	backend   backend.Backend
-}
+	server    *Server
 
-// HandleRequests handles an nbd requests for a single connection
-func (c *Connection) HandleRequests() {
-	for {
-		var req nbdRequest
-		err := binary.Read(c.plainconn, binary.BigEndian, &req)
-		if err != nil {
-			if errors.Cause(err) == io.EOF {
-				fmt.Println("Client closed connection abruptly")
-			} else {
-				fmt.Printf("Something went wrong reading a request: %v\n", err)
-				fmt.Println(req)
-			}
+	// the connection as it was accepted,
+	// plainconn is replaced when the connection is upgraded to TLS
+	rawconn net.Conn
 
-			return
-		}
+	// set when the connection was upgraded to TLS
+	tls bool
+	// identity of the client, empty when it did not authenticate
+	identity string
 
-		if req.NbdRequestMagic != NBD_REQUEST_MAGIC {
-			fmt.Printf("Client had bad magic number in request\n")
-			return
-		}
-		rh := nbdReply{
-			NbdReplyMagic: NBD_REPLY_MAGIC,
-			NbdHandle:     req.NbdHandle,
-			NbdError:      0,
-		}
+	// set when the client negotiated NBD_OPT_STRUCTURED_REPLY
+	structuredReplies bool
 
-		switch req.NbdCommandType {
-		case NBD_CMD_READ:
-			// read from backend
-			data, err := c.backend.ReadAt(nil, int64(req.NbdLength), int64(req.NbdLength))
-			if err != nil {
-				fmt.Printf("Something went wrong reading from backend: %v", err)
-				rh.NbdError = NBD_EIO
-			}
+	// set when the client selected the base:allocation metadata context
+	// for the export with the given name
+	baseAllocation    bool
+	metaContextExport string
 
-			// send reply header
-			binary.Write(c.plainconn, binary.BigEndian, &rh)
+	// set once the client selected an export
+	export   *Export
+	backend  backend.Backend
+	readOnly bool
 
-			// send data if no error occurred
-			if rh.NbdError == 0 {
-				binary.Write(c.plainconn, binary.BigEndian, data)
-			}
-		case NBD_CMD_WRITE:
-			// read data from request and write to backend
-			buf := make([]byte, req.NbdLength)
-			binary.Read(c.plainconn, binary.BigEndian, &buf)
+	// serializes writing replies during the transmission phase
+	writeMu sync.Mutex
 
-			_, err := c.backend.WriteAt(nil, buf, int64(req.NbdOffset))
-			if err != nil {
-				fmt.Printf("Something went wrong writing to the backend: %v", err)
-				rh.NbdError = NBD_EIO
-			}
-
-			if rh.NbdError == 0 {
-				err = c.backend.Flush(nil)
-				if err != nil {
-					fmt.Printf("Something went wrong flushing the backend: %v", err)
-					rh.NbdError = NBD_EIO
-				}
-			}
-
-			binary.Write(c.plainconn, binary.BigEndian, &rh)
-		case NBD_CMD_FLUSH:
-			err = c.backend.Flush(nil)
-			if err != nil {
-				fmt.Printf("flushing the backend failed: %s\n", err)
-				rh.NbdError = NBD_EIO
-			}
-
-			binary.Write(c.plainconn, binary.BigEndian, &rh)
-		default:
-			fmt.Printf("unsupported command %d\n", req.NbdCommandType)
-		}
-	}
+	// set once the negotiation completed, guarded by the mutex of the server
+	transmitting bool
 }
 
-// OldNegotiation executes an oldstyle negotiation
-func (c *Connection) OldNegotiation(exportSize uint64) error {
+// OldNegotiation executes an oldstyle negotiation,
+// which serves the given export as the client can't select one
+func (c *Connection) OldNegotiation(export *Export) error {
 	osh := nbdOldStyleHeader{
 		NbdMagic:        NBD_MAGIC,
 		NbdCliservMagic: NBD_CLISERV_MAGIC,
-		ExportSize:      exportSize,
-		Flags:           0x3,
+		ExportSize:      export.Backend.Size(),
+		Flags:           uint32(c.transmissionFlags(export)),
 	}
 
 	err := binary.Write(c.plainconn, binary.BigEndian, osh)
@@ -118,11 +76,18 @@ func (c *Connection) OldNegotiation(exportSize uint64) error {
 
 	// send empty reserved bytes
 	reserved := make([]byte, 124)
-	return binary.Write(c.plainconn, binary.BigEndian, reserved)
+	err = binary.Write(c.plainconn, binary.BigEndian, reserved)
+	if err != nil {
+		return err
+	}
+
+	c.setExport(export)
+	return nil
 }
 
 // Negotiate executes a fixed-newstyle negotiation
-func (c *Connection) Negotiate(exportSize uint64) (string, error) {
+// and returns the name of the export the client selected
+func (c *Connection) Negotiate() (string, error) {
 	// Send fixed-newstyle header
 	nsh := nbdNewStyleHeader{
 		NbdMagic:       NBD_MAGIC,
@@ -141,77 +106,374 @@ func (c *Connection) Negotiate(exportSize uint64) (string, error) {
 	var clf nbdClientFlags
 	err = binary.Read(c.plainconn, binary.BigEndian, &clf)
 	if err != nil {
+		if c.interrupted(err) {
+			return "", ErrServerClosed
+		}
 		return "", err
 	}
 
 	// Haggle client options
 	fmt.Println("Starting to haggle")
-	done := false
-	name := ""
-	for !done {
+	for {
 		var opt nbdClientOpt
 		err = binary.Read(c.plainconn, binary.BigEndian, &opt)
 		if err != nil {
+			// the client sent no option within the grace period of the shutdown
+			if c.interrupted(err) {
+				return "", ErrServerClosed
+			}
 			return "", err
 		}
+		if opt.NbdOptMagic != NBD_OPTS_MAGIC {
+			return "", errors.New("client had bad magic number in option")
+		}
+
+		// options are refused while the server is shutting down,
+		// there is no way to refuse NBD_OPT_EXPORT_NAME other than closing the connection
+		if c.server.shuttingDown() {
+			if opt.NbdOptID != NBD_OPT_EXPORT_NAME {
+				c.refuseOpt(opt, NBD_REP_ERR_SHUTDOWN, "server is shutting down")
+			}
+			return "", ErrServerClosed
+		}
+
+		// only TLS can be negotiated until it is up when it is required,
+		// the client can still abort the negotiation
+		if c.server.TLSMode == TLSRequired && !c.tls &&
+			opt.NbdOptID != NBD_OPT_STARTTLS && opt.NbdOptID != NBD_OPT_ABORT {
+			if opt.NbdOptID == NBD_OPT_EXPORT_NAME {
+				skip(c.plainconn, opt.NbdOptLen)
+				return "", errors.New("client requested an export without TLS")
+			}
+			err := c.refuseOpt(opt, NBD_REP_ERR_TLS_REQD, "TLS is required")
+			if err != nil {
+				return "", err
+			}
+			continue
+		}
 
 		switch opt.NbdOptID {
 		// this option also terminates a negotiation
 		case NBD_OPT_EXPORT_NAME:
-			// read name
-			nameBS := make([]byte, opt.NbdOptLen)
-			n, err := io.ReadFull(c.plainconn, nameBS)
+			return c.handleOptExportName(opt, clf)
+		// NBD_OPT_GO terminates a negotiation when it succeeds
+		case NBD_OPT_INFO, NBD_OPT_GO:
+			export, err := c.handleOptInfo(opt)
 			if err != nil {
 				return "", err
 			}
-			if uint32(n) != opt.NbdOptLen {
-				return "", errors.New("received incomplete name")
+			if export != nil {
+				c.setExport(export)
+				return export.Name, nil
 			}
-
-			// validate export name
-			name = string(nameBS)
-
-			// export details
-			ed := nbdExportDetails{
-				NbdExportSize:  exportSize,
-				NbdExportFlags: 333,
+		case NBD_OPT_LIST:
+			err := c.handleOptList(opt)
+			if err != nil {
+				return "", err
 			}
-			err = binary.Write(c.plainconn, binary.BigEndian, ed)
+		case NBD_OPT_STRUCTURED_REPLY:
+			err := c.handleOptStructuredReply(opt)
 			if err != nil {
-				return "", fmt.Errorf("something went wrong sending export details: %v", err)
+				return "", err
 			}
-
-			// empty zeroes
-			if clf.NbdClientFlags&NBD_FLAG_C_NO_ZEROES == 0 {
-				// send 124 bytes of zeroes.
-				zeroes := make([]byte, 124, 124)
-				if err := binary.Write(c.plainconn, binary.BigEndian, zeroes); err != nil {
-					return "", fmt.Errorf("Could not write zeroes: %v", err)
-				}
+		case NBD_OPT_LIST_META_CONTEXT, NBD_OPT_SET_META_CONTEXT:
+			err := c.handleOptMetaContext(opt)
+			if err != nil {
+				return "", err
 			}
-
-			done = true
-		default:
-			err := skip(c.plainconn, opt.NbdOptLen)
+		case NBD_OPT_STARTTLS:
+			err := c.handleOptStartTLS(opt)
 			if err != nil {
 				return "", err
 			}
-
+		case NBD_OPT_ABORT:
+			// the client may close the connection without reading the reply
+			c.refuseOpt(opt, NBD_REP_ACK, "")
+			return "", errors.New("client aborted the negotiation")
+		default:
 			// unsupported optID
-			or := nbdOptReply{
-				NbdOptReplyMagic:  NBD_REP_MAGIC,
-				NbdOptID:          opt.NbdOptID,
-				NbdOptReplyType:   NBD_REP_ERR_UNSUP,
-				NbdOptReplyLength: 0,
-			}
-			if err := binary.Write(c.plainconn, binary.BigEndian, or); err != nil {
+			err := c.refuseOpt(opt, NBD_REP_ERR_UNSUP, "")
+			if err != nil {
 				return "", fmt.Errorf("Cannot reply to unsupported option %s", err)
 			}
 		}
+	}
+}
+
+// handleOptExportName handles NBD_OPT_EXPORT_NAME,
+// which moves the connection to the transmission phase on success
+func (c *Connection) handleOptExportName(opt nbdClientOpt, clf nbdClientFlags) (string, error) {
+	if opt.NbdOptLen > maxOptionLength {
+		return "", errors.New("received export name that is too long")
+	}
+
+	// read name
+	nameBS := make([]byte, opt.NbdOptLen)
+	n, err := io.ReadFull(c.plainconn, nameBS)
+	if err != nil {
+		return "", err
+	}
+	if uint32(n) != opt.NbdOptLen {
+		return "", errors.New("received incomplete name")
+	}
+
+	// validate export name,
+	// there is no way to report an error for this option
+	// other than closing the connection
+	name := string(nameBS)
+	export, ok := c.server.Exports.Get(name)
+	if !ok {
+		return "", fmt.Errorf("client requested unknown export `%s`", name)
+	}
+	if c.access(export) == AccessDenied {
+		return "", fmt.Errorf("client `%s` is not allowed to open export `%s`", c.identity, name)
+	}
+
+	// export details
+	ed := nbdExportDetails{
+		NbdExportSize:  export.Backend.Size(),
+		NbdExportFlags: c.transmissionFlags(export),
+	}
+	err = binary.Write(c.plainconn, binary.BigEndian, ed)
+	if err != nil {
+		return "", fmt.Errorf("something went wrong sending export details: %v", err)
+	}
+
+	// empty zeroes
+	if clf.NbdClientFlags&NBD_FLAG_C_NO_ZEROES == 0 {
+		// send 124 bytes of zeroes.
+		zeroes := make([]byte, 124, 124)
+		if err := binary.Write(c.plainconn, binary.BigEndian, zeroes); err != nil {
+			return "", fmt.Errorf("Could not write zeroes: %v", err)
+		}
+	}
+
+	c.setExport(export)
+	return export.Name, nil
+}
+
+// handleOptInfo handles NBD_OPT_INFO and NBD_OPT_GO,
+// it returns the selected export when the connection should move to the transmission phase
+func (c *Connection) handleOptInfo(opt nbdClientOpt) (*Export, error) {
+	if opt.NbdOptLen > maxOptionLength {
+		err := skip(c.plainconn, opt.NbdOptLen)
+		if err != nil {
+			return nil, err
+		}
+		return nil, c.sendOptReply(opt.NbdOptID, NBD_REP_ERR_INVALID, []byte("option data too long"))
+	}
+
+	data := make([]byte, opt.NbdOptLen)
+	_, err := io.ReadFull(c.plainconn, data)
+	if err != nil {
+		return nil, err
+	}
+
+	name, infoReqs, err := parseInfoRequest(data)
+	if err != nil {
+		return nil, c.sendOptReply(opt.NbdOptID, NBD_REP_ERR_INVALID, []byte(err.Error()))
+	}
+
+	export, ok := c.server.Exports.Get(name)
+	if !ok {
+		return nil, c.sendOptReply(opt.NbdOptID, NBD_REP_ERR_UNKNOWN, []byte("unknown export"))
+	}
+	if c.access(export) == AccessDenied {
+		return nil, c.sendOptReply(opt.NbdOptID, NBD_REP_ERR_POLICY, []byte("access to export denied"))
+	}
+
+	// NBD_INFO_EXPORT is always sent
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, nbdInfoExport{
+		NbdInfoType:          NBD_INFO_EXPORT,
+		NbdExportSize:        export.Backend.Size(),
+		NbdTransmissionFlags: c.transmissionFlags(export),
+	})
+	err = c.sendOptReply(opt.NbdOptID, NBD_REP_INFO, buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	// unknown information requests are ignored
+	for _, infoReq := range infoReqs {
+		buf.Reset()
+		switch infoReq {
+		case NBD_INFO_NAME:
+			binary.Write(&buf, binary.BigEndian, uint16(NBD_INFO_NAME))
+			buf.WriteString(export.Name)
+		case NBD_INFO_DESCRIPTION:
+			binary.Write(&buf, binary.BigEndian, uint16(NBD_INFO_DESCRIPTION))
+			buf.WriteString(export.Description)
+		case NBD_INFO_BLOCK_SIZE:
+			binary.Write(&buf, binary.BigEndian, nbdInfoBlockSize{
+				NbdInfoType:           NBD_INFO_BLOCK_SIZE,
+				NbdMinimumBlockSize:   minimumBlockSize,
+				NbdPreferredBlockSize: preferredBlockSize,
+				NbdMaximumBlockSize:   maximumBlockSize,
+			})
+		default:
+			continue
+		}
+
+		err = c.sendOptReply(opt.NbdOptID, NBD_REP_INFO, buf.Bytes())
+		if err != nil {
+			return nil, err
+		}
+	}
 
+	err = c.sendOptReply(opt.NbdOptID, NBD_REP_ACK, nil)
+	if err != nil {
+		return nil, err
 	}
 
-	return name, nil
+	if opt.NbdOptID != NBD_OPT_GO {
+		return nil, nil
+	}
+	return export, nil
+}
+
+// handleOptList handles NBD_OPT_LIST
+// by sending an NBD_REP_SERVER reply for every listed export
+func (c *Connection) handleOptList(opt nbdClientOpt) error {
+	if opt.NbdOptLen != 0 {
+		err := skip(c.plainconn, opt.NbdOptLen)
+		if err != nil {
+			return err
+		}
+		return c.sendOptReply(opt.NbdOptID, NBD_REP_ERR_INVALID, []byte("list option does not take data"))
+	}
+
+	var buf bytes.Buffer
+	for _, export := range c.server.Exports.Exports() {
+		if c.server.ListPolicy != nil && !c.server.ListPolicy(export) {
+			continue
+		}
+		if c.access(export) == AccessDenied {
+			continue
+		}
+
+		buf.Reset()
+		binary.Write(&buf, binary.BigEndian, uint32(len(export.Name)))
+		buf.WriteString(export.Name)
+		buf.WriteString(export.Description)
+
+		err := c.sendOptReply(opt.NbdOptID, NBD_REP_SERVER, buf.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.sendOptReply(opt.NbdOptID, NBD_REP_ACK, nil)
+}
+
+// handleOptStructuredReply handles NBD_OPT_STRUCTURED_REPLY
+func (c *Connection) handleOptStructuredReply(opt nbdClientOpt) error {
+	if opt.NbdOptLen != 0 {
+		err := skip(c.plainconn, opt.NbdOptLen)
+		if err != nil {
+			return err
+		}
+		return c.sendOptReply(opt.NbdOptID, NBD_REP_ERR_INVALID, []byte("structured reply option does not take data"))
+	}
+
+	c.structuredReplies = true
+
+	return c.sendOptReply(opt.NbdOptID, NBD_REP_ACK, nil)
+}
+
+// parseInfoRequest parses the data of an NBD_OPT_INFO or NBD_OPT_GO option
+// into the requested export name and the requested information types
+func parseInfoRequest(data []byte) (string, []uint16, error) {
+	if len(data) < 4 {
+		return "", nil, errors.New("missing export name length")
+	}
+	nameLen := binary.BigEndian.Uint32(data)
+	data = data[4:]
+	if uint64(nameLen)+2 > uint64(len(data)) {
+		return "", nil, errors.New("export name length exceeds option length")
+	}
+	name := string(data[:nameLen])
+	data = data[nameLen:]
+
+	infoLen := binary.BigEndian.Uint16(data)
+	data = data[2:]
+	if int(infoLen)*2 != len(data) {
+		return "", nil, errors.New("information request count does not match option length")
+	}
+	infoReqs := make([]uint16, infoLen)
+	for i := range infoReqs {
+		infoReqs[i] = binary.BigEndian.Uint16(data[i*2:])
+	}
+
+	return name, infoReqs, nil
+}
+
+// setExport sets the export that is served during the transmission phase
+func (c *Connection) setExport(export *Export) {
+	c.export = export
+	c.backend = export.Backend
+	c.readOnly = c.readOnlyExport(export)
+
+	// metadata contexts were selected for another export
+	if c.metaContextExport != export.Name {
+		c.baseAllocation = false
+	}
+}
+
+// transmissionFlags returns the transmission flags sent to the client
+// for the given export, based on the configuration of the export,
+// the access of the client and the capabilities of its backend
+func (c *Connection) transmissionFlags(export *Export) uint16 {
+	flags := NBD_FLAG_HAS_FLAGS
+	if c.structuredReplies {
+		flags |= NBD_FLAG_SEND_DF
+	}
+	if export.Rotational {
+		flags |= NBD_FLAG_ROTATIONAL
+	}
+
+	// commands that modify the backend are not advertised for read-only exports
+	if c.readOnlyExport(export) {
+		return flags | NBD_FLAG_READ_ONLY
+	}
+
+	flags |= NBD_FLAG_SEND_FLUSH | NBD_FLAG_SEND_FUA | NBD_FLAG_SEND_WRITE_ZEROES
+	if _, ok := export.Backend.(backend.Trimmer); ok {
+		flags |= NBD_FLAG_SEND_TRIM
+	}
+	if _, ok := export.Backend.(backend.WriteZeroer); ok {
+		flags |= NBD_FLAG_SEND_FAST_ZERO
+	}
+
+	return flags
+}
+
+// refuseOpt skips the data of an option
+// and replies to it with the given error and message
+func (c *Connection) refuseOpt(opt nbdClientOpt, replyType uint32, msg string) error {
+	err := skip(c.plainconn, opt.NbdOptLen)
+	if err != nil {
+		return err
+	}
+
+	return c.sendOptReply(opt.NbdOptID, replyType, []byte(msg))
+}
+
+// sendOptReply sends an option reply with optional reply data
+func (c *Connection) sendOptReply(optID, replyType uint32, data []byte) error {
+	or := nbdOptReply{
+		NbdOptReplyMagic:  NBD_REP_MAGIC,
+		NbdOptID:          optID,
+		NbdOptReplyType:   replyType,
+		NbdOptReplyLength: uint32(len(data)),
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, or)
+	buf.Write(data)
+
+	_, err := c.plainconn.Write(buf.Bytes())
+	return err
 }
 
 // skip bytes
@@ -236,3 +498,22 @@ func skip(r io.Reader, n uint32) error {
 func (c *Connection) Close() {
 	c.plainconn.Close()
 }
+
+// interrupt stops reading new options or requests from the client,
+// the requests in flight are still replied to
+func (c *Connection) interrupt() {
+	c.rawconn.SetReadDeadline(time.Now())
+}
+
+// interruptNegotiation gives a client that is still negotiating
+// a grace period to send its next option,
+// which is refused with NBD_REP_ERR_SHUTDOWN
+func (c *Connection) interruptNegotiation() {
+	c.rawconn.SetReadDeadline(time.Now().Add(shutdownNegotiationGrace))
+}
+
+// forceClose closes the connection from another goroutine
+// than the one serving it
+func (c *Connection) forceClose() {
+	c.rawconn.Close()
+}
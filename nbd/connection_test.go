@@ -0,0 +1,573 @@
+package nbd
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/chrisvdg/nbdserver/nbd/backend"
+	"github.com/stretchr/testify/require"
+)
+
+const testExportSize = 1024 * 1024
+
+func TestNegotiate_Go(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+	export.Description = "test disk"
+
+	client, result := startNegotiation(t, newTestServer(t, export))
+	defer client.Close()
+
+	// request the export with its name, description and block size
+	sendInfoOpt(t, client, NBD_OPT_GO, "vdisk", NBD_INFO_NAME, NBD_INFO_DESCRIPTION, NBD_INFO_BLOCK_SIZE)
+
+	replyType, data := readOptReply(t, client, NBD_OPT_GO)
+	require.Equal(NBD_REP_INFO, replyType)
+	var info nbdInfoExport
+	require.NoError(binary.Read(bytes.NewReader(data), binary.BigEndian, &info))
+	require.Equal(uint16(NBD_INFO_EXPORT), info.NbdInfoType)
+	require.Equal(uint64(testExportSize), info.NbdExportSize)
+	require.NotZero(info.NbdTransmissionFlags & NBD_FLAG_HAS_FLAGS)
+
+	replyType, data = readOptReply(t, client, NBD_OPT_GO)
+	require.Equal(NBD_REP_INFO, replyType)
+	require.Equal(uint16(NBD_INFO_NAME), binary.BigEndian.Uint16(data))
+	require.Equal("vdisk", string(data[2:]))
+
+	replyType, data = readOptReply(t, client, NBD_OPT_GO)
+	require.Equal(NBD_REP_INFO, replyType)
+	require.Equal(uint16(NBD_INFO_DESCRIPTION), binary.BigEndian.Uint16(data))
+	require.Equal("test disk", string(data[2:]))
+
+	replyType, data = readOptReply(t, client, NBD_OPT_GO)
+	require.Equal(NBD_REP_INFO, replyType)
+	var bs nbdInfoBlockSize
+	require.NoError(binary.Read(bytes.NewReader(data), binary.BigEndian, &bs))
+	require.Equal(uint16(NBD_INFO_BLOCK_SIZE), bs.NbdInfoType)
+	require.Equal(uint32(preferredBlockSize), bs.NbdPreferredBlockSize)
+
+	replyType, _ = readOptReply(t, client, NBD_OPT_GO)
+	require.Equal(NBD_REP_ACK, replyType)
+
+	res := <-result
+	require.NoError(res.err)
+	require.Equal("vdisk", res.name)
+}
+
+func TestNegotiate_InfoThenGo(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+
+	client, result := startNegotiation(t, newTestServer(t, export))
+	defer client.Close()
+
+	// an unknown export is refused
+	sendInfoOpt(t, client, NBD_OPT_INFO, "unknown")
+	replyType, _ := readOptReply(t, client, NBD_OPT_INFO)
+	require.Equal(NBD_REP_ERR_UNKNOWN, replyType)
+
+	// info does not end the negotiation
+	sendInfoOpt(t, client, NBD_OPT_INFO, "vdisk")
+	replyType, _ = readOptReply(t, client, NBD_OPT_INFO)
+	require.Equal(NBD_REP_INFO, replyType)
+	replyType, _ = readOptReply(t, client, NBD_OPT_INFO)
+	require.Equal(NBD_REP_ACK, replyType)
+
+	// an empty name selects the default export
+	sendInfoOpt(t, client, NBD_OPT_GO, "")
+	replyType, _ = readOptReply(t, client, NBD_OPT_GO)
+	require.Equal(NBD_REP_INFO, replyType)
+	replyType, _ = readOptReply(t, client, NBD_OPT_GO)
+	require.Equal(NBD_REP_ACK, replyType)
+
+	res := <-result
+	require.NoError(res.err)
+	require.Equal("vdisk", res.name)
+}
+
+func TestNegotiate_Registry(t *testing.T) {
+	require := require.New(t)
+
+	first, cleanup := newTestExport(t, "first")
+	defer cleanup()
+	second, cleanup := newTestExport(t, "second")
+	defer cleanup()
+	server := newTestServer(t, first, second)
+
+	client, result := startNegotiation(t, server)
+	defer client.Close()
+
+	// exports that are removed can no longer be selected
+	_, err := server.Exports.Remove("first")
+	require.NoError(err)
+	sendInfoOpt(t, client, NBD_OPT_INFO, "first")
+	replyType, _ := readOptReply(t, client, NBD_OPT_INFO)
+	require.Equal(NBD_REP_ERR_UNKNOWN, replyType)
+
+	sendInfoOpt(t, client, NBD_OPT_GO, "second")
+	replyType, _ = readOptReply(t, client, NBD_OPT_GO)
+	require.Equal(NBD_REP_INFO, replyType)
+	replyType, _ = readOptReply(t, client, NBD_OPT_GO)
+	require.Equal(NBD_REP_ACK, replyType)
+
+	res := <-result
+	require.NoError(res.err)
+	require.Equal("second", res.name)
+}
+
+func TestNegotiate_UnknownExportName(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+
+	client, result := startNegotiation(t, newTestServer(t, export))
+	defer client.Close()
+
+	// the only way to refuse NBD_OPT_EXPORT_NAME is closing the connection
+	sendOpt(t, client, NBD_OPT_EXPORT_NAME, []byte("unknown"))
+
+	res := <-result
+	require.Error(res.err)
+}
+
+func TestNegotiate_List(t *testing.T) {
+	require := require.New(t)
+
+	first, cleanup := newTestExport(t, "first")
+	defer cleanup()
+	first.Description = "first disk"
+	hidden, cleanup := newTestExport(t, "hidden")
+	defer cleanup()
+	server := newTestServer(t, first, hidden)
+	server.ListPolicy = func(export *Export) bool {
+		return export.Name != "hidden"
+	}
+
+	client, _ := startNegotiation(t, server)
+	defer client.Close()
+
+	sendOpt(t, client, NBD_OPT_LIST, nil)
+
+	replyType, data := readOptReply(t, client, NBD_OPT_LIST)
+	require.Equal(NBD_REP_SERVER, replyType)
+	nameLen := binary.BigEndian.Uint32(data)
+	require.Equal("first", string(data[4:4+nameLen]))
+	require.Equal("first disk", string(data[4+nameLen:]))
+
+	replyType, _ = readOptReply(t, client, NBD_OPT_LIST)
+	require.Equal(NBD_REP_ACK, replyType)
+
+	// hidden exports can still be opened by name
+	sendInfoOpt(t, client, NBD_OPT_INFO, "hidden")
+	replyType, _ = readOptReply(t, client, NBD_OPT_INFO)
+	require.Equal(NBD_REP_INFO, replyType)
+}
+
+func TestNegotiate_MalformedInfo(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+
+	client, _ := startNegotiation(t, newTestServer(t, export))
+	defer client.Close()
+
+	// name length exceeds the option length
+	data := make([]byte, 6)
+	binary.BigEndian.PutUint32(data, 100)
+	sendOpt(t, client, NBD_OPT_GO, data)
+
+	replyType, _ := readOptReply(t, client, NBD_OPT_GO)
+	require.Equal(NBD_REP_ERR_INVALID, replyType)
+}
+
+func TestTrim(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+	data := []byte("Hello world!")
+	_, err := export.Backend.WriteAt(nil, data, 0)
+	require.NoError(err)
+
+	client, result := startNegotiation(t, newTestServer(t, export))
+	defer client.Close()
+
+	sendInfoOpt(t, client, NBD_OPT_GO, "vdisk")
+	_, info := readOptReply(t, client, NBD_OPT_GO)
+	require.NotZero(binary.BigEndian.Uint16(info[10:]) & NBD_FLAG_SEND_TRIM)
+	replyType, _ := readOptReply(t, client, NBD_OPT_GO)
+	require.Equal(NBD_REP_ACK, replyType)
+	require.NoError((<-result).err)
+
+	sendRequest(t, client, NBD_CMD_TRIM, 0, 1, 0, preferredBlockSize)
+	rh := readReply(t, client, 1)
+	require.Equal(uint32(0), rh.NbdError)
+
+	d, err := export.Backend.ReadAt(nil, 0, int64(len(data)))
+	require.NoError(err)
+	require.Equal(make([]byte, len(data)), d)
+}
+
+func TestTrim_Errors(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+	zb := &failingZeroBackend{Memory: export.Backend.(*backend.Memory)}
+	export.Backend = zb
+
+	client, result := startNegotiation(t, newTestServer(t, export))
+	defer client.Close()
+
+	sendInfoOpt(t, client, NBD_OPT_GO, "vdisk")
+	readOptReply(t, client, NBD_OPT_GO)
+	replyType, _ := readOptReply(t, client, NBD_OPT_GO)
+	require.Equal(NBD_REP_ACK, replyType)
+	require.NoError((<-result).err)
+
+	// trims the backend can't deallocate are ignored
+	zb.err = backend.ErrZeroNotSupported
+	sendRequest(t, client, NBD_CMD_TRIM, 0, 1, 0, preferredBlockSize)
+	require.Equal(uint32(0), readReply(t, client, 1).NbdError)
+
+	zb.err = errors.New("disk on fire")
+	sendRequest(t, client, NBD_CMD_TRIM, 0, 2, 0, preferredBlockSize)
+	require.Equal(uint32(NBD_EIO), readReply(t, client, 2).NbdError)
+}
+
+func TestWriteZeroes(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+	// hide the optional interfaces of the backend
+	plain := &Export{Name: "plain", Backend: struct{ backend.Backend }{export.Backend}}
+	data := []byte("Hello world!")
+
+	for _, exp := range []*Export{export, plain} {
+		_, err := export.Backend.WriteAt(nil, data, 0)
+		require.NoError(err)
+
+		client, result := startNegotiation(t, newTestServer(t, exp))
+		defer client.Close()
+
+		sendInfoOpt(t, client, NBD_OPT_GO, exp.Name)
+		_, info := readOptReply(t, client, NBD_OPT_GO)
+		require.NotZero(binary.BigEndian.Uint16(info[10:]) & NBD_FLAG_SEND_WRITE_ZEROES)
+		replyType, _ := readOptReply(t, client, NBD_OPT_GO)
+		require.Equal(NBD_REP_ACK, replyType)
+		require.NoError((<-result).err)
+
+		// only backends that can zero ranges support fast zeroes,
+		// which are invalid when they were not advertised
+		sendRequest(t, client, NBD_CMD_WRITE_ZEROES, NBD_CMD_FLAG_FAST_ZERO, 1, 0, preferredBlockSize)
+		rh := readReply(t, client, 1)
+		if exp == plain {
+			require.Equal(uint32(NBD_EINVAL), rh.NbdError)
+		} else {
+			require.Equal(uint32(0), rh.NbdError)
+		}
+
+		sendRequest(t, client, NBD_CMD_WRITE_ZEROES, NBD_CMD_FLAG_NO_HOLE, 2, 0, preferredBlockSize)
+		rh = readReply(t, client, 2)
+		require.Equal(uint32(0), rh.NbdError)
+
+		d, err := export.Backend.ReadAt(nil, 0, int64(len(data)))
+		require.NoError(err)
+		require.Equal(make([]byte, len(data)), d)
+	}
+}
+
+func TestWriteZeroes_Errors(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+	zb := &failingZeroBackend{Memory: export.Backend.(*backend.Memory)}
+	export.Backend = zb
+	data := []byte("Hello world!")
+	_, err := zb.WriteAt(nil, data, 0)
+	require.NoError(err)
+
+	client, result := startNegotiation(t, newTestServer(t, export))
+	defer client.Close()
+
+	sendInfoOpt(t, client, NBD_OPT_GO, "vdisk")
+	readOptReply(t, client, NBD_OPT_GO)
+	replyType, _ := readOptReply(t, client, NBD_OPT_GO)
+	require.Equal(NBD_REP_ACK, replyType)
+	require.NoError((<-result).err)
+
+	// backend errors are not masked by writing zeroes instead
+	zb.err = errors.New("disk on fire")
+	sendRequest(t, client, NBD_CMD_WRITE_ZEROES, 0, 1, 0, preferredBlockSize)
+	require.Equal(uint32(NBD_EIO), readReply(t, client, 1).NbdError)
+	d, err := zb.ReadAt(nil, 0, int64(len(data)))
+	require.NoError(err)
+	require.Equal(data, d)
+
+	// backends that can't zero the range get zeroes written
+	zb.err = backend.ErrZeroNotSupported
+	sendRequest(t, client, NBD_CMD_WRITE_ZEROES, NBD_CMD_FLAG_FAST_ZERO, 2, 0, preferredBlockSize)
+	require.Equal(uint32(NBD_ENOTSUP), readReply(t, client, 2).NbdError)
+	sendRequest(t, client, NBD_CMD_WRITE_ZEROES, 0, 3, 0, preferredBlockSize)
+	require.Equal(uint32(0), readReply(t, client, 3).NbdError)
+	d, err = zb.ReadAt(nil, 0, int64(len(data)))
+	require.NoError(err)
+	require.Equal(make([]byte, len(data)), d)
+}
+
+// failingZeroBackend fails to zero and trim ranges with the configured error
+type failingZeroBackend struct {
+	*backend.Memory
+	err error
+}
+
+func (b *failingZeroBackend) Trim(ctx context.Context, offset, length int64) error {
+	return b.err
+}
+
+func (b *failingZeroBackend) WriteZeroes(ctx context.Context, offset, length int64, noHole bool) error {
+	return b.err
+}
+
+func TestWrite_FUA(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+	fb := &flushCountingBackend{Backend: export.Backend}
+	export.Backend = fb
+
+	client, result := startNegotiation(t, newTestServer(t, export))
+	defer client.Close()
+
+	sendInfoOpt(t, client, NBD_OPT_GO, "vdisk")
+	_, info := readOptReply(t, client, NBD_OPT_GO)
+	require.NotZero(binary.BigEndian.Uint16(info[10:]) & NBD_FLAG_SEND_FUA)
+	replyType, _ := readOptReply(t, client, NBD_OPT_GO)
+	require.Equal(NBD_REP_ACK, replyType)
+	require.NoError((<-result).err)
+
+	data := []byte("Hello world!")
+
+	// plain writes are not flushed
+	sendRequest(t, client, NBD_CMD_WRITE, 0, 1, 0, uint32(len(data)))
+	_, err := client.Write(data)
+	require.NoError(err)
+	require.Equal(uint32(0), readReply(t, client, 1).NbdError)
+	require.Equal(0, fb.flushes)
+
+	sendRequest(t, client, NBD_CMD_WRITE, NBD_CMD_FLAG_FUA, 2, 0, uint32(len(data)))
+	_, err = client.Write(data)
+	require.NoError(err)
+	require.Equal(uint32(0), readReply(t, client, 2).NbdError)
+	require.Equal(1, fb.flushes)
+
+	sendRequest(t, client, NBD_CMD_FLUSH, 0, 3, 0, 0)
+	require.Equal(uint32(0), readReply(t, client, 3).NbdError)
+	require.Equal(2, fb.flushes)
+}
+
+func TestDisconnect(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+	fb := &flushCountingBackend{Backend: export.Backend}
+	export.Backend = fb
+
+	for _, clean := range []bool{true, false} {
+		client, result := startNegotiation(t, newTestServer(t, export))
+
+		sendInfoOpt(t, client, NBD_OPT_GO, "vdisk")
+		readOptReply(t, client, NBD_OPT_GO)
+		replyType, _ := readOptReply(t, client, NBD_OPT_GO)
+		require.Equal(NBD_REP_ACK, replyType)
+		require.NoError((<-result).err)
+
+		if clean {
+			// a disconnect flushes the backend and is not replied to
+			sendRequest(t, client, NBD_CMD_DISC, 0, 1, 0, 0)
+			res := <-result
+			require.True(res.handled)
+			require.NoError(res.err)
+			require.Equal(1, fb.flushes)
+		} else {
+			client.Close()
+			res := <-result
+			require.True(res.handled)
+			require.Error(res.err)
+		}
+		client.Close()
+	}
+}
+
+func TestTransmissionFlags(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+	c := &Connection{server: &Server{}}
+
+	flags := c.transmissionFlags(export)
+	require.Equal(NBD_FLAG_HAS_FLAGS|NBD_FLAG_SEND_FLUSH|NBD_FLAG_SEND_FUA|NBD_FLAG_SEND_TRIM|
+		NBD_FLAG_SEND_WRITE_ZEROES|NBD_FLAG_SEND_FAST_ZERO, flags)
+
+	// optional backend capabilities are only advertised when available
+	plain := &Export{Backend: struct{ backend.Backend }{export.Backend}, Rotational: true}
+	flags = c.transmissionFlags(plain)
+	require.Equal(NBD_FLAG_HAS_FLAGS|NBD_FLAG_SEND_FLUSH|NBD_FLAG_SEND_FUA|
+		NBD_FLAG_SEND_WRITE_ZEROES|NBD_FLAG_ROTATIONAL, flags)
+
+	readOnly := &Export{Backend: export.Backend, ReadOnly: true}
+	flags = c.transmissionFlags(readOnly)
+	require.Equal(NBD_FLAG_HAS_FLAGS|NBD_FLAG_READ_ONLY, flags)
+
+	// backends can report being read-only
+	readOnlyBackend := &Export{Backend: readOnlyTestBackend{export.Backend}}
+	flags = c.transmissionFlags(readOnlyBackend)
+	require.Equal(NBD_FLAG_HAS_FLAGS|NBD_FLAG_READ_ONLY, flags)
+
+	c.structuredReplies = true
+	flags = c.transmissionFlags(readOnly)
+	require.Equal(NBD_FLAG_HAS_FLAGS|NBD_FLAG_READ_ONLY|NBD_FLAG_SEND_DF, flags)
+}
+
+// readOnlyTestBackend wraps a backend that reports being read-only
+type readOnlyTestBackend struct {
+	backend.Backend
+}
+
+func (readOnlyTestBackend) ReadOnly() bool { return true }
+
+type negotiationResult struct {
+	name    string
+	err     error
+	handled bool
+}
+
+// newTestExport returns an export backed by memory
+func newTestExport(t *testing.T, name string) (*Export, func()) {
+	export := &Export{
+		Name:    name,
+		Backend: backend.NewMemory(testExportSize),
+	}
+
+	return export, func() {
+		export.Backend.Close(nil)
+	}
+}
+
+// newTestServer returns a server serving the given exports
+func newTestServer(t *testing.T, exports ...*Export) *Server {
+	registry := NewRegistry()
+	for _, export := range exports {
+		require.NoError(t, registry.Add(export))
+	}
+
+	return NewServer(registry)
+}
+
+// startNegotiation starts a server side negotiation
+// and returns the client side of the connection after the initial handshake.
+// Requests are handled once the negotiation succeeded,
+// after which a second result is sent with the result of handling the requests.
+func startNegotiation(t *testing.T, server *Server) (net.Conn, <-chan negotiationResult) {
+	client, plainconn := net.Pipe()
+
+	conn, err := NewConn(plainconn, server)
+	require.NoError(t, err)
+
+	result := make(chan negotiationResult, 2)
+	go func() {
+		defer conn.Close()
+		name, err := conn.Negotiate()
+		result <- negotiationResult{name: name, err: err}
+		if err == nil {
+			err = conn.HandleRequests()
+			result <- negotiationResult{name: name, err: err, handled: true}
+		}
+	}()
+
+	var nsh nbdNewStyleHeader
+	require.NoError(t, binary.Read(client, binary.BigEndian, &nsh))
+	require.Equal(t, uint64(NBD_MAGIC), nsh.NbdMagic)
+	require.Equal(t, uint64(NBD_OPTS_MAGIC), nsh.NbdOptsMagic)
+
+	clf := nbdClientFlags{NbdClientFlags: NBD_FLAG_C_FIXED_NEWSTYLE | NBD_FLAG_C_NO_ZEROES}
+	require.NoError(t, binary.Write(client, binary.BigEndian, clf))
+
+	return client, result
+}
+
+// sendOpt sends an option with the given data
+func sendOpt(t *testing.T, w io.Writer, optID uint32, data []byte) {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, nbdClientOpt{
+		NbdOptMagic: NBD_OPTS_MAGIC,
+		NbdOptID:    optID,
+		NbdOptLen:   uint32(len(data)),
+	})
+	buf.Write(data)
+
+	_, err := w.Write(buf.Bytes())
+	require.NoError(t, err)
+}
+
+// sendInfoOpt sends an NBD_OPT_INFO or NBD_OPT_GO option
+func sendInfoOpt(t *testing.T, w io.Writer, optID uint32, name string, infoReqs ...uint16) {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(len(name)))
+	buf.WriteString(name)
+	binary.Write(&buf, binary.BigEndian, uint16(len(infoReqs)))
+	binary.Write(&buf, binary.BigEndian, infoReqs)
+
+	sendOpt(t, w, optID, buf.Bytes())
+}
+
+// readOptReply reads an option reply and returns its type and data
+func readOptReply(t *testing.T, r io.Reader, optID uint32) (uint32, []byte) {
+	var or nbdOptReply
+	require.NoError(t, binary.Read(r, binary.BigEndian, &or))
+	require.Equal(t, uint64(NBD_REP_MAGIC), or.NbdOptReplyMagic)
+	require.Equal(t, optID, or.NbdOptID)
+
+	data := make([]byte, or.NbdOptReplyLength)
+	_, err := io.ReadFull(r, data)
+	require.NoError(t, err)
+
+	return or.NbdOptReplyType, data
+}
+
+// readReply reads a simple reply
+func readReply(t *testing.T, r io.Reader, handle uint64) nbdReply {
+	var rh nbdReply
+	require.NoError(t, binary.Read(r, binary.BigEndian, &rh))
+	require.Equal(t, uint32(NBD_REPLY_MAGIC), rh.NbdReplyMagic)
+	require.Equal(t, handle, rh.NbdHandle)
+
+	return rh
+}
+
+// flushCountingBackend counts the flushes of a backend
+type flushCountingBackend struct {
+	backend.Backend
+	flushes int
+}
+
+func (b *flushCountingBackend) Flush(ctx context.Context) error {
+	b.flushes++
+	return b.Backend.Flush(ctx)
+}
@@ -0,0 +1,16 @@
+package nbd
+
+import "github.com/chrisvdg/nbdserver/nbd/backend"
+
+// Export represents a named backend that is served over NBD
+type Export struct {
+	Name        string
+	Description string
+	Backend     backend.Backend
+	// ReadOnly advertises the export as read-only
+	// and refuses all requests that would modify the backend
+	ReadOnly bool
+	// Rotational advertises the backend as a rotational medium,
+	// clients may schedule their requests accordingly
+	Rotational bool
+}
@@ -0,0 +1,137 @@
+package nbd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// systemdFirstFD is the first file descriptor passed by systemd socket activation
+const systemdFirstFD = 3
+
+// ListenUnix listens on a unix domain socket at the given path
+// and gives the socket the given permissions.
+// The socket is bound in a private directory next to the path
+// and only moved into place once it has its permissions,
+// so no client can connect to it before that.
+// A stale socket left behind at the path is removed first,
+// the socket is removed again when the listener is closed.
+func ListenUnix(path string, perm os.FileMode) (net.Listener, error) {
+	info, err := os.Lstat(path)
+	if err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("`%s` exists and is not a socket", path)
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not remove stale socket")
+		}
+	}
+
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".nbd")
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create a directory for the socket")
+	}
+	defer os.RemoveAll(dir)
+
+	tmpPath := filepath.Join(dir, "sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmpPath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// the socket is removed from its final path instead
+	l.SetUnlinkOnClose(false)
+
+	err = os.Chmod(tmpPath, perm)
+	if err != nil {
+		l.Close()
+		return nil, errors.Wrap(err, "could not set the permissions of the socket")
+	}
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		l.Close()
+		return nil, errors.Wrap(err, "could not move the socket into place")
+	}
+
+	return &unixListener{UnixListener: l, path: path}, nil
+}
+
+// unixListener is a unix domain socket listener
+// that removes its socket from the given path when it is closed
+type unixListener struct {
+	*net.UnixListener
+	path      string
+	closeOnce sync.Once
+}
+
+// Close implements net.Listener.Close
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	l.closeOnce.Do(func() {
+		os.Remove(l.path)
+	})
+
+	return err
+}
+
+// SystemdListeners returns the listeners passed by systemd socket activation,
+// as described by the LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES environment variables.
+// No listeners are returned when the process was not socket activated.
+// The environment variables are unset so they are not inherited by child processes.
+func SystemdListeners() ([]net.Listener, error) {
+	return systemdListeners(systemdFirstFD)
+}
+
+// systemdListeners returns the listeners passed by systemd socket activation,
+// starting at the given file descriptor
+func systemdListeners(firstFD int) ([]net.Listener, error) {
+	pid, fds, names := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	if pid == "" || fds == "" {
+		return nil, nil
+	}
+	if pid != strconv.Itoa(os.Getpid()) {
+		// the file descriptors were meant for another process
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS `%s`", fds)
+	}
+
+	var fdNames []string
+	if names != "" {
+		fdNames = strings.Split(names, ":")
+	}
+
+	listeners := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		name := "LISTEN_FD_" + strconv.Itoa(firstFD+i)
+		if i < len(fdNames) {
+			name = fdNames[i]
+		}
+
+		file := os.NewFile(uintptr(firstFD+i), name)
+		l, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, errors.Wrapf(err, "file descriptor %d (%s) is not a listener", firstFD+i, name)
+		}
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}
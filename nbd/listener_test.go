@@ -0,0 +1,106 @@
+package nbd
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenUnix(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "nbd_test_socket")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "nbd.sock")
+
+	// stale sockets are replaced
+	stale, err := net.Listen("unix", path)
+	require.NoError(err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := ListenUnix(path, 0600)
+	require.NoError(err)
+	info, err := os.Stat(path)
+	require.NoError(err)
+	require.Equal(os.FileMode(0600), info.Mode().Perm())
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+	server := newTestServer(t, export)
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(l)
+	}()
+
+	conn, err := net.Dial("unix", path)
+	require.NoError(err)
+	client, err := NewClient(conn, "vdisk")
+	require.NoError(err)
+	_, err = client.ReadAt(make([]byte, 512), 0)
+	require.NoError(err)
+	require.NoError(client.Close())
+
+	require.NoError(server.Shutdown(context.Background()))
+	require.Equal(ErrServerClosed, <-served)
+
+	// the socket is removed with the listener,
+	// no temporary files are left behind
+	_, err = os.Stat(path)
+	require.True(os.IsNotExist(err))
+	entries, err := ioutil.ReadDir(dir)
+	require.NoError(err)
+	require.Empty(entries)
+
+	// files that are not sockets are left alone
+	require.NoError(ioutil.WriteFile(path, nil, 0600))
+	_, err = ListenUnix(path, 0600)
+	require.Error(err)
+}
+
+func TestSystemdListeners(t *testing.T) {
+	require := require.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer l.Close()
+	// the listener takes ownership of the file descriptor
+	file, err := l.(*net.TCPListener).File()
+	require.NoError(err)
+	fd, err := syscall.Dup(int(file.Fd()))
+	require.NoError(err)
+	file.Close()
+
+	// file descriptors meant for other processes are ignored
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+	listeners, err := systemdListeners(fd)
+	require.NoError(err)
+	require.Empty(listeners)
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "1")
+	os.Setenv("LISTEN_FDNAMES", "nbd")
+	listeners, err = systemdListeners(fd)
+	require.NoError(err)
+	require.Len(listeners, 1)
+	defer listeners[0].Close()
+	require.Equal(l.Addr().String(), listeners[0].Addr().String())
+
+	// the environment is not passed on
+	require.Empty(os.Getenv("LISTEN_PID"))
+	require.Empty(os.Getenv("LISTEN_FDS"))
+	require.Empty(os.Getenv("LISTEN_FDNAMES"))
+
+	listeners, err = SystemdListeners()
+	require.NoError(err)
+	require.Empty(listeners)
+}
@@ -15,13 +15,21 @@ const (
 	NBD_CMD_FLUSH        = 3
 	NBD_CMD_TRIM         = 4
 	NBD_CMD_WRITE_ZEROES = 6
+	NBD_CMD_BLOCK_STATUS = 7
 )
 
 // NBD command flags
 const (
-	NBD_CMD_FLAG_FUA = uint16(1 << 0)
-	NBD_CMD_MAY_TRIM = uint16(1 << 1)
-	NBD_CMD_FLAG_DF  = uint16(1 << 2)
+	NBD_CMD_FLAG_FUA       = uint16(1 << 0)
+	NBD_CMD_FLAG_NO_HOLE   = uint16(1 << 1)
+	NBD_CMD_FLAG_DF        = uint16(1 << 2)
+	NBD_CMD_FLAG_REQ_ONE   = uint16(1 << 3)
+	NBD_CMD_FLAG_FAST_ZERO = uint16(1 << 4)
+
+	// NBD_CMD_MAY_TRIM is the former name of NBD_CMD_FLAG_NO_HOLE.
+	//
+	// Deprecated: use NBD_CMD_FLAG_NO_HOLE instead.
+	NBD_CMD_MAY_TRIM = NBD_CMD_FLAG_NO_HOLE
 )
 
 // NBD negotiation flags
@@ -35,6 +43,7 @@ const (
 	NBD_FLAG_SEND_WRITE_ZEROES = uint16(1 << 6)
 	NBD_FLAG_SEND_DF           = uint16(1 << 7)
 	NBD_FLAG_SEND_CLOSE        = uint16(1 << 8)
+	NBD_FLAG_SEND_FAST_ZERO    = uint16(1 << 11)
 )
 
 // NBD magic numbers
@@ -55,14 +64,16 @@ const (
 
 // NBD options
 const (
-	NBD_OPT_EXPORT_NAME      = 1
-	NBD_OPT_ABORT            = 2
-	NBD_OPT_LIST             = 3
-	NBD_OPT_PEEK_EXPORT      = 4
-	NBD_OPT_STARTTLS         = 5
-	NBD_OPT_INFO             = 6
-	NBD_OPT_GO               = 7
-	NBD_OPT_STRUCTURED_REPLY = 8
+	NBD_OPT_EXPORT_NAME       = 1
+	NBD_OPT_ABORT             = 2
+	NBD_OPT_LIST              = 3
+	NBD_OPT_PEEK_EXPORT       = 4
+	NBD_OPT_STARTTLS          = 5
+	NBD_OPT_INFO              = 6
+	NBD_OPT_GO                = 7
+	NBD_OPT_STRUCTURED_REPLY  = 8
+	NBD_OPT_LIST_META_CONTEXT = 9
+	NBD_OPT_SET_META_CONTEXT  = 10
 )
 
 // NBD option reply types
@@ -70,6 +81,7 @@ const (
 	NBD_REP_ACK                 = uint32(1)
 	NBD_REP_SERVER              = uint32(2)
 	NBD_REP_INFO                = uint32(3)
+	NBD_REP_META_CONTEXT        = uint32(4)
 	NBD_REP_FLAG_ERROR          = uint32(1 << 31)
 	NBD_REP_ERR_UNSUP           = uint32(1 | NBD_REP_FLAG_ERROR)
 	NBD_REP_ERR_POLICY          = uint32(2 | NBD_REP_FLAG_ERROR)
@@ -93,6 +105,7 @@ const (
 	NBD_REPLY_TYPE_ERROR_OFFSET = 2
 	NBD_REPLY_TYPE_OFFSET_DATA  = 3
 	NBD_REPLY_TYPE_OFFSET_HOLE  = 4
+	NBD_REPLY_TYPE_BLOCK_STATUS = 5
 )
 
 // NBD hanshake flags
@@ -107,6 +120,12 @@ const (
 	NBD_FLAG_C_NO_ZEROES      = 1 << 1
 )
 
+// NBD base:allocation metadata context states
+const (
+	NBD_STATE_HOLE = uint32(1 << 0)
+	NBD_STATE_ZERO = uint32(1 << 1)
+)
+
 // NBD errors
 const (
 	NBD_EPERM     = 1
@@ -115,6 +134,7 @@ const (
 	NBD_EINVAL    = 22
 	NBD_ENOSPC    = 28
 	NBD_EOVERFLOW = 75
+	NBD_ENOTSUP   = 95
 )
 
 // NBD info types
@@ -183,6 +203,15 @@ type nbdReply struct {
 	NbdHandle     uint64
 }
 
+// NBD structured reply chunk
+type nbdStructuredReply struct {
+	NbdStructuredReplyMagic uint32
+	NbdFlags                uint16
+	NbdType                 uint16
+	NbdHandle               uint64
+	NbdLength               uint32
+}
+
 // NBD info export
 type nbdInfoExport struct {
 	NbdInfoType          uint16
@@ -208,14 +237,25 @@ const (
 	CMDT_REP_PAYLOAD                         // reply carries a payload
 	CMDT_CHECK_NOT_READ_ONLY                 // not valid on read-only media
 	CMDT_SET_DISCONNECT_RECEIVED             // a disconnect - don't process any further commands
+	CMDT_REP_STRUCTURED                      // reply is a structured reply when those are negotiated
+)
+
+// Limits used during negotiation and transmission
+const (
+	maxOptionLength    = 4096             // maximum length of option data we are willing to read
+	minimumBlockSize   = 1                // minimum block size advertised to the client
+	preferredBlockSize = 4096             // preferred block size advertised to the client
+	maximumBlockSize   = 32 * 1024 * 1024 // maximum payload size advertised to the client
+	maxOptReplyLength  = 64 * 1024        // maximum length of option reply data a client is willing to read
 )
 
 // CmdTypeMap is a map specifying each command
 var CmdTypeMap = map[int]uint64{
-	NBD_CMD_READ:         CMDT_CHECK_LENGTH_OFFSET | CMDT_REP_PAYLOAD,
+	NBD_CMD_READ:         CMDT_CHECK_LENGTH_OFFSET | CMDT_REP_PAYLOAD | CMDT_REP_STRUCTURED,
 	NBD_CMD_WRITE:        CMDT_CHECK_LENGTH_OFFSET | CMDT_CHECK_NOT_READ_ONLY | CMDT_REQ_PAYLOAD,
 	NBD_CMD_DISC:         CMDT_SET_DISCONNECT_RECEIVED,
 	NBD_CMD_FLUSH:        CMDT_CHECK_NOT_READ_ONLY,
 	NBD_CMD_TRIM:         CMDT_CHECK_LENGTH_OFFSET | CMDT_CHECK_NOT_READ_ONLY,
 	NBD_CMD_WRITE_ZEROES: CMDT_CHECK_LENGTH_OFFSET | CMDT_CHECK_NOT_READ_ONLY | CMDT_REQ_FAKE_PAYLOAD,
+	NBD_CMD_BLOCK_STATUS: CMDT_CHECK_LENGTH_OFFSET | CMDT_REP_STRUCTURED,
 }
@@ -0,0 +1,109 @@
+package nbd
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// NewRegistry returns a new, empty export registry
+func NewRegistry() *Registry {
+	return &Registry{
+		exports: make(map[string]*Export),
+	}
+}
+
+// Registry maps export names to exports,
+// exports can be added and removed while the server is running
+type Registry struct {
+	mu          sync.RWMutex
+	exports     map[string]*Export
+	defaultName string
+}
+
+// Add adds an export to the registry,
+// the first export that is added becomes the default export
+func (r *Registry) Add(export *Export) error {
+	if export == nil || export.Backend == nil {
+		return errors.New("export has no backend")
+	}
+	if export.Name == "" {
+		return errors.New("export has no name")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.exports[export.Name]; ok {
+		return errors.Errorf("export `%s` already exists", export.Name)
+	}
+	r.exports[export.Name] = export
+	if r.defaultName == "" {
+		r.defaultName = export.Name
+	}
+
+	return nil
+}
+
+// Remove removes an export from the registry and returns it.
+// Connections that already opened the export keep using it,
+// closing its backend is up to the caller.
+func (r *Registry) Remove(name string) (*Export, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	export, ok := r.exports[name]
+	if !ok {
+		return nil, errors.Errorf("export `%s` does not exist", name)
+	}
+	delete(r.exports, name)
+	if r.defaultName == name {
+		r.defaultName = ""
+	}
+
+	return export, nil
+}
+
+// SetDefault sets the export that is used when a client requests an empty name
+func (r *Registry) SetDefault(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.exports[name]; !ok {
+		return errors.Errorf("export `%s` does not exist", name)
+	}
+	r.defaultName = name
+
+	return nil
+}
+
+// Get returns the export with the given name,
+// an empty name resolves to the default export
+func (r *Registry) Get(name string) (*Export, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if name == "" {
+		name = r.defaultName
+	}
+	export, ok := r.exports[name]
+
+	return export, ok
+}
+
+// Exports returns all exports in the registry sorted by name
+func (r *Registry) Exports() []*Export {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	exports := make([]*Export, 0, len(r.exports))
+	for _, export := range r.exports {
+		exports = append(exports, export)
+	}
+	sort.Slice(exports, func(i, j int) bool {
+		return exports[i].Name < exports[j].Name
+	})
+
+	return exports
+}
@@ -0,0 +1,52 @@
+package nbd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	require := require.New(t)
+
+	first, cleanup := newTestExport(t, "first")
+	defer cleanup()
+	second, cleanup := newTestExport(t, "second")
+	defer cleanup()
+
+	r := NewRegistry()
+	_, ok := r.Get("")
+	require.False(ok, "an empty registry has no default export")
+
+	require.NoError(r.Add(second))
+	require.NoError(r.Add(first))
+	require.Error(r.Add(first), "export names should be unique")
+	require.Error(r.Add(&Export{Backend: first.Backend}), "exports should have a name")
+
+	// the first added export is the default
+	export, ok := r.Get("")
+	require.True(ok)
+	require.Equal("second", export.Name)
+
+	require.NoError(r.SetDefault("first"))
+	export, ok = r.Get("")
+	require.True(ok)
+	require.Equal("first", export.Name)
+	require.Error(r.SetDefault("unknown"))
+
+	exports := r.Exports()
+	require.Len(exports, 2)
+	require.Equal("first", exports[0].Name)
+	require.Equal("second", exports[1].Name)
+
+	// removing the default export leaves no default
+	export, err := r.Remove("first")
+	require.NoError(err)
+	require.Equal(first, export)
+	_, ok = r.Get("")
+	require.False(ok)
+	_, ok = r.Get("first")
+	require.False(ok)
+	_, err = r.Remove("first")
+	require.Error(err)
+}
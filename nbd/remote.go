@@ -0,0 +1,322 @@
+package nbd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/chrisvdg/nbdserver/nbd/backend"
+	"github.com/pkg/errors"
+)
+
+// Defaults used to reconnect to the upstream server of a RemoteBackend
+const (
+	defaultMinBackoff = 100 * time.Millisecond
+	defaultMaxBackoff = 10 * time.Second
+	defaultMaxRetries = 5
+)
+
+// errRemoteClosed is returned for requests on a closed remote backend
+var errRemoteClosed = errors.New("remote backend is closed")
+
+// NewRemoteBackend returns a backend that forwards requests
+// to the export with the given name of the upstream NBD server at the given address,
+// using up to poolSize connections at the same time.
+// A first connection is made to learn the size of the export.
+func NewRemoteBackend(address, export string, poolSize int) (*RemoteBackend, error) {
+	return newRemoteBackend(func() (*Client, error) {
+		return Dial(address, export)
+	}, poolSize)
+}
+
+// newRemoteBackend returns a remote backend that connects using the given dial function
+func newRemoteBackend(dial func() (*Client, error), poolSize int) (*RemoteBackend, error) {
+	if poolSize <= 0 {
+		poolSize = 1
+	}
+
+	client, err := dial()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not connect to the upstream server")
+	}
+
+	r := &RemoteBackend{
+		MinBackoff: defaultMinBackoff,
+		MaxBackoff: defaultMaxBackoff,
+		MaxRetries: defaultMaxRetries,
+		dial:       dial,
+		size:       client.Size(),
+		readOnly:   client.ReadOnly(),
+		pool:       make(chan *Client, poolSize),
+		closed:     make(chan struct{}),
+	}
+
+	// slots without a client are connected when they are used
+	r.pool <- client
+	for i := 1; i < poolSize; i++ {
+		r.pool <- nil
+	}
+
+	return r, nil
+}
+
+// RemoteBackend represents a backend that forwards requests
+// to an export of an upstream NBD server.
+// Requests that fail because the connection to the upstream server dropped
+// are retried on a new connection, backing off between the attempts.
+type RemoteBackend struct {
+	// MinBackoff and MaxBackoff bound the time waited before reconnecting,
+	// which doubles after every failed attempt
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// MaxRetries is the number of times a request is retried
+	// after its connection dropped
+	MaxRetries int
+
+	dial     func() (*Client, error)
+	size     uint64
+	readOnly bool
+
+	// holds a slot for every connection that can be used,
+	// slots are nil until they are connected
+	pool chan *Client
+	// takeAllMu serializes takeAll,
+	// as callers holding part of the slots would wait for each other forever
+	takeAllMu sync.Mutex
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+var (
+	_ backend.Backend    = (*RemoteBackend)(nil)
+	_ backend.ReadOnlyer = (*RemoteBackend)(nil)
+)
+
+// ReadOnly implements ReadOnlyer.ReadOnly,
+// it returns whether the upstream export is read-only
+func (r *RemoteBackend) ReadOnly() bool {
+	return r.readOnly
+}
+
+// Size implements Backend.Size
+func (r *RemoteBackend) Size() uint64 {
+	return r.size
+}
+
+// WriteAt implements Backend.WriteAt
+func (r *RemoteBackend) WriteAt(ctx context.Context, b []byte, offset int64) (int64, error) {
+	var n int
+	err := r.do(ctx, func(client *Client) error {
+		var err error
+		n, err = client.WriteAt(b, offset)
+		return err
+	})
+
+	return int64(n), err
+}
+
+// ReadAt implements Backend.ReadAt
+func (r *RemoteBackend) ReadAt(ctx context.Context, offset, length int64) ([]byte, error) {
+	bytes := make([]byte, length)
+	err := r.do(ctx, func(client *Client) error {
+		_, err := client.ReadAt(bytes, offset)
+		return err
+	})
+
+	return bytes, err
+}
+
+// Flush implements Backend.Flush,
+// every connection is flushed as the upstream server
+// is not required to flush writes made over other connections
+func (r *RemoteBackend) Flush(ctx context.Context) error {
+	if r.readOnly {
+		return nil
+	}
+
+	clients, err := r.takeAll(ctx)
+	if err != nil {
+		return err
+	}
+
+	for i, client := range clients {
+		if client == nil {
+			continue
+		}
+		err = client.Flush()
+		if err != nil {
+			if client.broken() {
+				client.Close()
+				clients[i] = nil
+			}
+			break
+		}
+	}
+
+	for _, client := range clients {
+		r.pool <- client
+	}
+
+	return err
+}
+
+// Close implements Backend.Close
+func (r *RemoteBackend) Close(ctx context.Context) error {
+	clients, err := r.takeAll(ctx)
+	if err != nil {
+		return err
+	}
+
+	r.closeOnce.Do(func() {
+		close(r.closed)
+	})
+
+	for _, client := range clients {
+		if client != nil {
+			client.Close()
+		}
+		r.pool <- nil
+	}
+
+	return nil
+}
+
+// do calls fn with a connection to the upstream server,
+// fn is retried on a new connection when the connection dropped
+func (r *RemoteBackend) do(ctx context.Context, fn func(client *Client) error) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	backoff := r.MinBackoff
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			err := r.sleep(ctx, backoff)
+			if err != nil {
+				return err
+			}
+			backoff *= 2
+			if backoff > r.MaxBackoff {
+				backoff = r.MaxBackoff
+			}
+		}
+
+		client, err := r.take(ctx)
+		if err != nil {
+			return err
+		}
+
+		if client == nil {
+			client, err = r.connect()
+			if err != nil {
+				r.pool <- nil
+				if attempt < r.MaxRetries {
+					continue
+				}
+				return err
+			}
+		}
+
+		err = fn(client)
+		if err == nil {
+			r.pool <- client
+			return nil
+		}
+
+		// only requests that broke the connection are retried
+		if !client.broken() {
+			r.pool <- client
+			return err
+		}
+
+		client.Close()
+		r.pool <- nil
+		if attempt >= r.MaxRetries {
+			return errors.Wrap(err, "connection to the upstream server dropped")
+		}
+		fmt.Printf("Connection to the upstream server dropped, retrying: %v\n", err)
+	}
+}
+
+// connect makes a new connection to the upstream server
+// and verifies the export did not change
+func (r *RemoteBackend) connect() (*Client, error) {
+	client, err := r.dial()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not connect to the upstream server")
+	}
+	if client.Size() != r.size {
+		client.Close()
+		return nil, fmt.Errorf("size of the upstream export changed from %d to %d", r.size, client.Size())
+	}
+
+	return client, nil
+}
+
+// take takes a slot from the pool,
+// waiting until one is available
+func (r *RemoteBackend) take(ctx context.Context) (*Client, error) {
+	select {
+	case <-r.closed:
+		return nil, errRemoteClosed
+	default:
+	}
+
+	select {
+	case client := <-r.pool:
+		// the backend could have been closed while waiting
+		select {
+		case <-r.closed:
+			r.pool <- client
+			return nil, errRemoteClosed
+		default:
+		}
+		return client, nil
+	case <-r.closed:
+		return nil, errRemoteClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// takeAll takes every slot from the pool,
+// which waits for all requests in progress
+func (r *RemoteBackend) takeAll(ctx context.Context) ([]*Client, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	r.takeAllMu.Lock()
+	defer r.takeAllMu.Unlock()
+
+	clients := make([]*Client, 0, cap(r.pool))
+	for len(clients) < cap(r.pool) {
+		client, err := r.take(ctx)
+		if err != nil {
+			for _, client := range clients {
+				r.pool <- client
+			}
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+
+	return clients, nil
+}
+
+// sleep waits for the given duration unless the context is done
+// or the backend is closed
+func (r *RemoteBackend) sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-r.closed:
+		return errRemoteClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,205 @@
+package nbd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoteBackend(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+	upstream := newTestUpstream(newTestServer(t, export), "vdisk")
+
+	remote, err := newRemoteBackend(upstream.dial, 4)
+	require.NoError(err)
+	require.Equal(uint64(testExportSize), remote.Size())
+	require.False(remote.ReadOnly())
+
+	errs := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		go func(i int) {
+			data := bytes.Repeat([]byte{byte(i + 1)}, 512)
+			_, err := remote.WriteAt(nil, data, int64(i)*512)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			read, err := remote.ReadAt(nil, int64(i)*512, 512)
+			if err == nil && !bytes.Equal(data, read) {
+				err = fmt.Errorf("read %v at %d, expected %v", read[:4], i*512, data[:4])
+			}
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < 16; i++ {
+		require.NoError(<-errs)
+	}
+	require.NoError(remote.Flush(nil))
+
+	// no more connections are made than the size of the pool
+	require.True(upstream.dials() <= 4)
+
+	require.NoError(remote.Close(nil))
+	_, err = remote.ReadAt(nil, 0, 512)
+	require.Error(err)
+}
+
+func TestRemoteBackend_Reconnect(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+	upstream := newTestUpstream(newTestServer(t, export), "vdisk")
+
+	remote, err := newRemoteBackend(upstream.dial, 1)
+	require.NoError(err)
+	defer remote.Close(nil)
+	remote.MinBackoff = time.Millisecond
+
+	data := bytes.Repeat([]byte{1}, 512)
+	_, err = remote.WriteAt(nil, data, 0)
+	require.NoError(err)
+
+	// the request is retried on a new connection
+	upstream.drop()
+	read, err := remote.ReadAt(nil, 0, 512)
+	require.NoError(err)
+	require.Equal(data, read)
+	require.Equal(2, upstream.dials())
+
+	// until the retries are exhausted
+	remote.MaxRetries = 2
+	upstream.drop()
+	upstream.fail(true)
+	_, err = remote.ReadAt(nil, 0, 512)
+	require.Error(err)
+
+	upstream.fail(false)
+	_, err = remote.ReadAt(nil, 0, 512)
+	require.NoError(err)
+}
+
+func TestRemoteBackend_ConcurrentFlush(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+	upstream := newTestUpstream(newTestServer(t, export), "vdisk")
+
+	remote, err := newRemoteBackend(upstream.dial, 8)
+	require.NoError(err)
+
+	// flushes that each take every connection don't wait for each other forever
+	const flushes = 16
+	errs := make(chan error, flushes+1)
+	for i := 0; i < flushes; i++ {
+		go func(i int) {
+			_, err := remote.WriteAt(nil, []byte{byte(i)}, int64(i))
+			if err == nil {
+				err = remote.Flush(nil)
+			}
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < flushes; i++ {
+		select {
+		case err := <-errs:
+			require.NoError(err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("concurrent flushes deadlocked")
+		}
+	}
+
+	// neither does closing while flushing
+	go func() {
+		errs <- remote.Flush(nil)
+	}()
+	require.NoError(remote.Close(nil))
+	select {
+	case err := <-errs:
+		if err != nil {
+			require.Equal(errRemoteClosed, err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("flushing while closing deadlocked")
+	}
+}
+
+// testUpstream serves an export to the connections of a remote backend
+type testUpstream struct {
+	server *Server
+	name   string
+
+	mu      sync.Mutex
+	n       int
+	failing bool
+	conns   []net.Conn
+}
+
+// newTestUpstream returns an upstream serving the export with the given name
+func newTestUpstream(server *Server, name string) *testUpstream {
+	return &testUpstream{server: server, name: name}
+}
+
+// dial returns a client connected to the upstream
+func (u *testUpstream) dial() (*Client, error) {
+	u.mu.Lock()
+	if u.failing {
+		u.mu.Unlock()
+		return nil, errors.New("upstream is down")
+	}
+	u.n++
+	client, plainconn := net.Pipe()
+	u.conns = append(u.conns, plainconn)
+	u.mu.Unlock()
+
+	// dial is called from the goroutines of the remote backend,
+	// so errors are returned rather than failing the test
+	conn, err := NewConn(plainconn, u.server)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		defer conn.Close()
+		_, err := conn.Negotiate()
+		if err == nil {
+			conn.HandleRequests()
+		}
+	}()
+
+	return NewClient(client, u.name)
+}
+
+// dials returns the number of connections made to the upstream
+func (u *testUpstream) dials() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.n
+}
+
+// drop closes all connections to the upstream
+func (u *testUpstream) drop() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, conn := range u.conns {
+		conn.Close()
+	}
+	u.conns = nil
+}
+
+// fail makes new connections to the upstream fail
+func (u *testUpstream) fail(failing bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.failing = failing
+}
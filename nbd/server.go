@@ -1,55 +1,384 @@
 package nbd
 
 import (
+	"context"
+	"crypto/tls"
+	stderrors "errors"
 	"fmt"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/chrisvdg/nbdserver/nbd/backend"
+	"github.com/pkg/errors"
 )
 
-// NewServer returns a new server
-func NewServer(backend backend.Backend) *Server {
+// ErrServerClosed is returned by Serve and ListenAndServe after the server was shut down
+var ErrServerClosed = errors.New("nbd: server closed")
+
+// Defaults used when accepting and negotiating connections
+const (
+	defaultHandshakeTimeout = 30 * time.Second
+	minAcceptDelay          = 5 * time.Millisecond
+	maxAcceptDelay          = time.Second
+	// shutdownNegotiationGrace is the time a negotiating client gets
+	// to send its next option when the server shuts down
+	shutdownNegotiationGrace = time.Second
+)
+
+// NewServer returns a new server serving the exports of the given registry
+func NewServer(exports *Registry) *Server {
 	return &Server{
-		Backend: backend,
+		Exports: exports,
 	}
 }
 
 // Server represents an NBD server
 type Server struct {
-	Backend backend.Backend
+	// metrics is updated atomically, it must stay the first field
+	// to be 64-bit aligned on 32-bit platforms
+	metrics Metrics
+
+	Exports *Registry
+
+	// ListPolicy decides if an export is shown to clients listing the exports,
+	// all exports are listed when it is nil.
+	// Hidden exports can still be opened by name.
+	ListPolicy func(export *Export) bool
+
+	// TLSMode defines whether clients can or must upgrade to TLS
+	// using TLSConfig, which should contain at least one certificate
+	TLSMode   TLSMode
+	TLSConfig *tls.Config
+
+	// ACL restricts the exports clients can list and open based on their identity,
+	// all exports are accessible to every client when it is nil.
+	// Exports that are denied to a client are refused with NBD_REP_ERR_POLICY.
+	// Client certificates are only used as identity when they were verified,
+	// so TLSConfig should set ClientAuth to VerifyClientCertIfGiven
+	// or RequireAndVerifyClientCert.
+	ACL *ACL
+	// Identify returns the identity of a client from its TLS connection,
+	// the common name of its certificate is used when it is nil.
+	// Clients that did not upgrade to TLS have the empty identity.
+	Identify func(state tls.ConnectionState) string
+
+	// MaxInFlight is the maximum number of requests of a single connection
+	// that are handled concurrently, a default is used when it is not set
+	MaxInFlight int
+
+	// HandshakeTimeout is the time a client gets to complete the negotiation,
+	// a default is used when it is not set
+	HandshakeTimeout time.Duration
+
+	inShutdown int32
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	conns      map[*Connection]struct{}
+	connWg     sync.WaitGroup
+}
+
+// Metrics holds counters about the connections of a server
+type Metrics struct {
+	// Connections is the number of accepted connections
+	Connections uint64
+	// CleanDisconnects is the number of clients that disconnected with NBD_CMD_DISC
+	CleanDisconnects uint64
+	// ShutdownDisconnects is the number of connections in the transmission phase
+	// that were closed by a graceful shutdown
+	ShutdownDisconnects uint64
+	// AbruptDisconnects is the number of connections that ended in any other way
+	// after the negotiation
+	AbruptDisconnects uint64
+}
+
+// Metrics returns a snapshot of the connection metrics of the server
+func (s *Server) Metrics() Metrics {
+	return Metrics{
+		Connections:         atomic.LoadUint64(&s.metrics.Connections),
+		CleanDisconnects:    atomic.LoadUint64(&s.metrics.CleanDisconnects),
+		ShutdownDisconnects: atomic.LoadUint64(&s.metrics.ShutdownDisconnects),
+		AbruptDisconnects:   atomic.LoadUint64(&s.metrics.AbruptDisconnects),
+	}
 }
 
 // ListenAndServe starts listening for requests and serves them
+// until the server is shut down, after which ErrServerClosed is returned
 func (s *Server) ListenAndServe(address string) error {
 	l, err := net.Listen("tcp", address)
 	if err != nil {
 		return err
 	}
+
+	return s.Serve(l)
+}
+
+// Serve accepts connections on the given listener
+// and serves every connection in its own goroutine
+// until the server is shut down, after which ErrServerClosed is returned.
+// The listener is closed when Serve returns.
+// Accept errors are retried with a backoff,
+// serving only stops when the listener was closed.
+// An error is returned right away when TLS is required without a TLSConfig.
+func (s *Server) Serve(l net.Listener) error {
+	return s.serve(l, (*Connection).Negotiate)
+}
+
+// ListenAndServeOldstyle starts listening for oldstyle clients
+// and serves them the export with the given name
+func (s *Server) ListenAndServeOldstyle(address, exportName string) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	return s.ServeOldstyle(l, exportName)
+}
+
+// ServeOldstyle accepts connections on the given listener like Serve,
+// but executes an oldstyle negotiation with its clients,
+// which serves them the export with the given name as they can't select one.
+// Oldstyle clients can't upgrade to TLS,
+// so they are refused when the server requires TLS.
+func (s *Server) ServeOldstyle(l net.Listener, exportName string) error {
+	if s.TLSMode == TLSRequired {
+		l.Close()
+		return errors.New("oldstyle clients can't be served when TLS is required")
+	}
+
+	return s.serve(l, func(c *Connection) (string, error) {
+		export, ok := s.Exports.Get(exportName)
+		if !ok {
+			return "", fmt.Errorf("export `%s` does not exist", exportName)
+		}
+		if c.access(export) == AccessDenied {
+			return "", fmt.Errorf("client is not allowed to open export `%s`", exportName)
+		}
+
+		return export.Name, c.OldNegotiation(export)
+	})
+}
+
+// serve accepts connections on the given listener
+// and serves every connection in its own goroutine
+// after negotiating with the given function
+func (s *Server) serve(l net.Listener, negotiate func(c *Connection) (string, error)) error {
+	// no client could ever complete the negotiation
+	if s.TLSMode == TLSRequired && s.TLSConfig == nil {
+		l.Close()
+		return errors.New("TLS is required but no TLS config is set")
+	}
+	if !s.trackListener(l, true) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(l, false)
 	defer l.Close()
 
-	// handle connections
+	var delay time.Duration
 	for {
 		plainConn, err := l.Accept()
 		if err != nil {
-			log.Printf("Something went wrong accepting the connection: %s\n", err)
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			if stderrors.Is(err, net.ErrClosed) {
+				return err
+			}
+			if delay == 0 {
+				delay = minAcceptDelay
+			} else {
+				delay *= 2
+			}
+			if delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+			log.Printf("Something went wrong accepting the connection: %s, retrying in %v\n", err, delay)
+			time.Sleep(delay)
+			continue
 		}
-		fmt.Printf("Accepted connection from %s\n", plainConn.RemoteAddr().String())
+		delay = 0
 
-		conn, err := NewConn(plainConn, s.Backend)
+		fmt.Printf("Accepted connection from %s\n", plainConn.RemoteAddr().String())
+		atomic.AddUint64(&s.metrics.Connections, 1)
 
-		name, err := conn.Negotiate(s.Backend.Size())
+		conn, err := NewConn(plainConn, s)
 		if err != nil {
-			fmt.Printf("Something went wrong negotiating: %s\n", err)
-			return err
+			log.Printf("Something went wrong creating the connection: %s\n", err)
+			plainConn.Close()
+			continue
 		}
+		// the deadline is set before the connection is tracked,
+		// so it can't overwrite the interruption of a shutdown
+		timeout := s.HandshakeTimeout
+		if timeout <= 0 {
+			timeout = defaultHandshakeTimeout
+		}
+		conn.rawconn.SetDeadline(time.Now().Add(timeout))
 
-		fmt.Println("Done negotiating")
-		fmt.Printf("got vdiskID: %s\n", name)
-
-		go func() {
-			conn.HandleRequests()
+		if !s.trackConn(conn, true) {
 			conn.Close()
-		}()
+			return ErrServerClosed
+		}
+
+		go s.serveConn(conn, negotiate)
+	}
+}
+
+// Shutdown gracefully shuts down the server.
+// It stops accepting connections and stops reading from all connections:
+// clients that are still negotiating get a short grace period
+// in which their next option is refused with NBD_REP_ERR_SHUTDOWN,
+// after which they are disconnected,
+// and the requests in flight of clients in the transmission phase are drained.
+// Once all connections are closed the backends of the exports are flushed and closed.
+// When the context is done before that, the remaining connections are closed forcibly
+// and the error of the context is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	atomic.StoreInt32(&s.inShutdown, 1)
+	for l := range s.listeners {
+		l.Close()
 	}
+	for conn := range s.conns {
+		if conn.transmitting {
+			conn.interrupt()
+		} else {
+			conn.interruptNegotiation()
+		}
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.connWg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.forceClose()
+		}
+		s.mu.Unlock()
+		<-done
+	}
+
+	for _, export := range s.Exports.Exports() {
+		if ferr := export.Backend.Flush(nil); ferr != nil {
+			fmt.Printf("Something went wrong flushing export `%s`: %v\n", export.Name, ferr)
+		}
+		if cerr := export.Backend.Close(nil); cerr != nil {
+			fmt.Printf("Something went wrong closing export `%s`: %v\n", export.Name, cerr)
+		}
+	}
+
+	return err
+}
+
+// shuttingDown returns whether the server is shutting down
+func (s *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&s.inShutdown) != 0
+}
+
+// trackListener adds or removes a listener that is closed on shutdown,
+// false is returned when a listener is added to a server that is shutting down
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !add {
+		delete(s.listeners, l)
+		return true
+	}
+	if s.shuttingDown() {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[l] = struct{}{}
+
+	return true
+}
+
+// trackConn adds or removes a connection that is waited for on shutdown,
+// false is returned when a connection is added to a server that is shutting down
+func (s *Server) trackConn(conn *Connection, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !add {
+		delete(s.conns, conn)
+		s.connWg.Done()
+		return true
+	}
+	if s.shuttingDown() {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[*Connection]struct{})
+	}
+	s.conns[conn] = struct{}{}
+	s.connWg.Add(1)
+
+	return true
+}
+
+// startTransmission clears the deadline of the negotiation of a connection,
+// which is interrupted again right away when the server is already shutting down
+func (s *Server) startTransmission(conn *Connection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conn.rawconn.SetDeadline(time.Time{})
+	conn.transmitting = true
+	if s.shuttingDown() {
+		conn.interrupt()
+	}
+}
+
+// serveConn negotiates with the client of a connection,
+// handles its requests and closes it once the client disconnects.
+// The negotiation has to complete within the handshake timeout,
+// which is set when the connection is accepted.
+func (s *Server) serveConn(conn *Connection, negotiate func(c *Connection) (string, error)) {
+	defer s.trackConn(conn, false)
+	defer conn.Close()
+
+	remote := conn.plainconn.RemoteAddr().String()
+
+	name, err := negotiate(conn)
+	if err == ErrServerClosed {
+		fmt.Printf("Negotiation with %s ended for shutdown\n", remote)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Something went wrong negotiating with %s: %s\n", remote, err)
+		return
+	}
+
+	fmt.Printf("Done negotiating with %s, serving export: %s\n", remote, name)
+
+	s.startTransmission(conn)
+
+	err = conn.HandleRequests()
+	if err == ErrServerClosed {
+		atomic.AddUint64(&s.metrics.ShutdownDisconnects, 1)
+		fmt.Printf("Connection with %s closed for shutdown\n", remote)
+		return
+	}
+	if err != nil {
+		atomic.AddUint64(&s.metrics.AbruptDisconnects, 1)
+		fmt.Printf("Connection with %s ended: %v\n", remote, err)
+		return
+	}
+
+	atomic.AddUint64(&s.metrics.CleanDisconnects, 1)
+	fmt.Printf("Client %s disconnected\n", remote)
 }
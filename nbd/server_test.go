@@ -0,0 +1,450 @@
+package nbd
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chrisvdg/nbdserver/nbd/backend"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_Shutdown(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+	b := &closeTrackingBackend{Backend: export.Backend}
+	export.Backend = b
+	server := newTestServer(t, export)
+	server.HandshakeTimeout = time.Minute
+	address, served := startServer(t, server)
+
+	// a client in the transmission phase
+	client, err := Dial(address, "vdisk")
+	require.NoError(err)
+	defer client.Close()
+	_, err = client.WriteAt([]byte{1, 2, 3, 4}, 0)
+	require.NoError(err)
+
+	// and an idle client that is still negotiating
+	negotiating, err := net.Dial("tcp", address)
+	require.NoError(err)
+	defer negotiating.Close()
+	var nsh nbdNewStyleHeader
+	require.NoError(binary.Read(negotiating, binary.BigEndian, &nsh))
+	clf := nbdClientFlags{NbdClientFlags: NBD_FLAG_C_FIXED_NEWSTYLE}
+	require.NoError(binary.Write(negotiating, binary.BigEndian, clf))
+
+	// neither keeps the server from shutting down before the handshake timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(server.Shutdown(ctx))
+	require.Equal(ErrServerClosed, <-served)
+
+	// the negotiating client was disconnected
+	_, err = negotiating.Read(make([]byte, 1))
+	require.Error(err)
+
+	// the client in the transmission phase didn't disconnect abruptly
+	metrics := server.Metrics()
+	require.Equal(uint64(1), metrics.ShutdownDisconnects)
+	require.Equal(uint64(0), metrics.AbruptDisconnects)
+
+	// the backend was flushed and closed after the connections ended
+	flushes, closes := b.counts()
+	require.Equal(1, flushes)
+	require.Equal(1, closes)
+
+	// new connections are refused
+	_, err = net.Dial("tcp", address)
+	require.Error(err)
+}
+
+func TestServer_ShutdownDuringPayload(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+	server := newTestServer(t, export)
+	address, served := startServer(t, server)
+
+	client, err := net.Dial("tcp", address)
+	require.NoError(err)
+	defer client.Close()
+	var nsh nbdNewStyleHeader
+	require.NoError(binary.Read(client, binary.BigEndian, &nsh))
+	clf := nbdClientFlags{NbdClientFlags: NBD_FLAG_C_FIXED_NEWSTYLE | NBD_FLAG_C_NO_ZEROES}
+	require.NoError(binary.Write(client, binary.BigEndian, clf))
+	sendInfoOpt(t, client, NBD_OPT_GO, "vdisk")
+	readOptReply(t, client, NBD_OPT_GO)
+	replyType, _ := readOptReply(t, client, NBD_OPT_GO)
+	require.Equal(NBD_REP_ACK, replyType)
+
+	// the server is interrupted while it reads the payload of a write
+	sendRequest(t, client, NBD_CMD_WRITE, 0, 1, 0, 4)
+	_, err = client.Write([]byte{1, 2})
+	require.NoError(err)
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(server.Shutdown(ctx))
+	require.Equal(ErrServerClosed, <-served)
+
+	metrics := server.Metrics()
+	require.Equal(uint64(1), metrics.ShutdownDisconnects)
+	require.Equal(uint64(0), metrics.AbruptDisconnects)
+}
+
+func TestServer_ShutdownRefusesOptions(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+	server := newTestServer(t, export)
+	address, served := startServer(t, server)
+
+	client, err := net.Dial("tcp", address)
+	require.NoError(err)
+	defer client.Close()
+	var nsh nbdNewStyleHeader
+	require.NoError(binary.Read(client, binary.BigEndian, &nsh))
+	clf := nbdClientFlags{NbdClientFlags: NBD_FLAG_C_FIXED_NEWSTYLE | NBD_FLAG_C_NO_ZEROES}
+	require.NoError(binary.Write(client, binary.BigEndian, clf))
+	sendOpt(t, client, NBD_OPT_LIST, nil)
+	for {
+		replyType, _ := readOptReply(t, client, NBD_OPT_LIST)
+		if replyType == NBD_REP_ACK {
+			break
+		}
+	}
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- server.Shutdown(context.Background())
+	}()
+	require.Equal(ErrServerClosed, <-served)
+
+	// the next option of a negotiating client is refused
+	sendOpt(t, client, NBD_OPT_LIST, nil)
+	replyType, _ := readOptReply(t, client, NBD_OPT_LIST)
+	require.Equal(NBD_REP_ERR_SHUTDOWN, replyType)
+	require.NoError(<-shutdown)
+
+	_, err = client.Read(make([]byte, 1))
+	require.Error(err)
+}
+
+func TestServer_ShutdownTimeout(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+	blocking := &blockingBackend{
+		Backend: export.Backend,
+		unblock: make(chan struct{}),
+		blocked: make(chan struct{}, 1),
+	}
+	export.Backend = blocking
+	server := newTestServer(t, export)
+	address, served := startServer(t, server)
+
+	// a client with a request that doesn't finish in time
+	client, err := Dial(address, "vdisk")
+	require.NoError(err)
+	defer client.Close()
+	read := make(chan error, 1)
+	go func() {
+		_, err := client.ReadAt(make([]byte, 512), 0)
+		read <- err
+	}()
+	<-blocking.blocked
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	go func() {
+		// the request finishes once its connection was closed
+		<-ctx.Done()
+		time.Sleep(50 * time.Millisecond)
+		close(blocking.unblock)
+	}()
+	require.Equal(context.DeadlineExceeded, server.Shutdown(ctx))
+	require.Equal(ErrServerClosed, <-served)
+
+	// the connection was closed forcibly
+	require.Error(<-read)
+}
+
+// startServer serves the server on a free local port
+// and returns its address and the result of serving
+func startServer(t *testing.T, server *Server) (string, <-chan error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(l)
+	}()
+
+	return l.Addr().String(), served
+}
+
+// closeTrackingBackend counts the flushes and closes of a backend
+type closeTrackingBackend struct {
+	backend.Backend
+
+	mu      sync.Mutex
+	flushes int
+	closes  int
+}
+
+func (b *closeTrackingBackend) Flush(ctx context.Context) error {
+	b.mu.Lock()
+	b.flushes++
+	b.mu.Unlock()
+	return b.Backend.Flush(ctx)
+}
+
+func (b *closeTrackingBackend) Close(ctx context.Context) error {
+	b.mu.Lock()
+	b.closes++
+	b.mu.Unlock()
+	return b.Backend.Close(ctx)
+}
+
+func (b *closeTrackingBackend) counts() (int, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.flushes, b.closes
+}
+
+func TestServer_ConcurrentNegotiation(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+	server := newTestServer(t, export)
+	address, _ := startServer(t, server)
+	defer server.Shutdown(context.Background())
+
+	// a client that stalls its negotiation
+	idle, err := net.Dial("tcp", address)
+	require.NoError(err)
+	defer idle.Close()
+
+	// a client that fails its negotiation
+	bad, err := net.Dial("tcp", address)
+	require.NoError(err)
+	defer bad.Close()
+	var nsh nbdNewStyleHeader
+	require.NoError(binary.Read(bad, binary.BigEndian, &nsh))
+	require.NoError(binary.Write(bad, binary.BigEndian, nbdClientFlags{NbdClientFlags: NBD_FLAG_C_FIXED_NEWSTYLE}))
+	require.NoError(binary.Write(bad, binary.BigEndian, nbdClientOpt{NbdOptMagic: 42}))
+	_, err = bad.Read(make([]byte, 1))
+	require.Error(err)
+
+	// neither keeps other clients from being served
+	client, err := Dial(address, "vdisk")
+	require.NoError(err)
+	_, err = client.ReadAt(make([]byte, 512), 0)
+	require.NoError(err)
+	require.NoError(client.Close())
+}
+
+func TestServer_HandshakeTimeout(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+	server := newTestServer(t, export)
+	server.HandshakeTimeout = 50 * time.Millisecond
+	address, _ := startServer(t, server)
+	defer server.Shutdown(context.Background())
+
+	idle, err := net.Dial("tcp", address)
+	require.NoError(err)
+	defer idle.Close()
+	var nsh nbdNewStyleHeader
+	require.NoError(binary.Read(idle, binary.BigEndian, &nsh))
+
+	// the server closes the connection once the timeout expired
+	_, err = idle.Read(make([]byte, 1))
+	require.Error(err)
+
+	// clients that negotiate in time are not affected by the timeout
+	client, err := Dial(address, "vdisk")
+	require.NoError(err)
+	time.Sleep(100 * time.Millisecond)
+	_, err = client.ReadAt(make([]byte, 512), 0)
+	require.NoError(err)
+	require.NoError(client.Close())
+}
+
+func TestServer_AcceptError(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+	server := newTestServer(t, export)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(&flakyListener{Listener: l, failures: 4})
+	}()
+
+	// temporary and other accept errors are retried
+	client, err := Dial(l.Addr().String(), "vdisk")
+	require.NoError(err)
+	require.NoError(client.Close())
+
+	require.NoError(server.Shutdown(context.Background()))
+	require.Equal(ErrServerClosed, <-served)
+
+	// serving stops once the listener is closed
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	go func() {
+		served <- newTestServer(t, export).Serve(l)
+	}()
+	client, err = Dial(l.Addr().String(), "vdisk")
+	require.NoError(err)
+	require.NoError(client.Close())
+	l.Close()
+	require.True(errors.Is(<-served, net.ErrClosed))
+}
+
+// flakyListener fails to accept a number of times before accepting connections
+type flakyListener struct {
+	net.Listener
+	failures int
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		if l.failures%2 == 0 {
+			return nil, errors.New("too many open files")
+		}
+		return nil, temporaryError{}
+	}
+	return l.Listener.Accept()
+}
+
+// temporaryError is a temporary network error
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary error" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+func TestServer_BothHandshakes(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+	server := newTestServer(t, export)
+	address, _ := startServer(t, server)
+	oldstyleAddress, oldstyleServed := startOldstyleServer(t, server, "vdisk")
+
+	// data written by a newstyle client
+	client, err := Dial(address, "vdisk")
+	require.NoError(err)
+	data := bytes.Repeat([]byte{1, 2, 3, 4}, 128)
+	_, err = client.WriteAt(data, 512)
+	require.NoError(err)
+	require.NoError(client.Close())
+
+	// is read by an oldstyle client
+	oldstyle, err := net.Dial("tcp", oldstyleAddress)
+	require.NoError(err)
+	defer oldstyle.Close()
+	osh := readOldstyleHeader(t, oldstyle)
+	require.Equal(uint64(testExportSize), osh.ExportSize)
+	require.Equal(uint32(NBD_FLAG_HAS_FLAGS|NBD_FLAG_SEND_FLUSH|NBD_FLAG_SEND_FUA|NBD_FLAG_SEND_TRIM|
+		NBD_FLAG_SEND_WRITE_ZEROES|NBD_FLAG_SEND_FAST_ZERO), osh.Flags)
+
+	sendRequest(t, oldstyle, NBD_CMD_READ, 0, 1, 512, uint32(len(data)))
+	require.Equal(uint32(0), readReply(t, oldstyle, 1).NbdError)
+	require.Equal(data, readData(t, oldstyle, len(data)))
+
+	sendRequest(t, oldstyle, NBD_CMD_DISC, 0, 2, 0, 0)
+
+	require.NoError(server.Shutdown(context.Background()))
+	require.Equal(ErrServerClosed, <-oldstyleServed)
+}
+
+func TestServer_OldstyleReadOnly(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+	export.ReadOnly = true
+	server := newTestServer(t, export)
+	address, _ := startOldstyleServer(t, server, "vdisk")
+	defer server.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", address)
+	require.NoError(err)
+	defer conn.Close()
+	osh := readOldstyleHeader(t, conn)
+	require.Equal(uint32(NBD_FLAG_HAS_FLAGS|NBD_FLAG_READ_ONLY), osh.Flags)
+
+	sendRequest(t, conn, NBD_CMD_TRIM, 0, 1, 0, 512)
+	require.Equal(uint32(NBD_EPERM), readReply(t, conn, 1).NbdError)
+}
+
+func TestServer_OldstyleRequiresNoTLS(t *testing.T) {
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+	server := newTestServer(t, export)
+	server.TLSMode = TLSRequired
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.Error(t, server.ServeOldstyle(l, "vdisk"))
+}
+
+func TestServer_TLSRequiredWithoutConfig(t *testing.T) {
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+	server := newTestServer(t, export)
+	server.TLSMode = TLSRequired
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.Error(t, server.Serve(l))
+}
+
+// startOldstyleServer serves the export with the given name to oldstyle clients
+// on a free local port and returns its address and the result of serving
+func startOldstyleServer(t *testing.T, server *Server, name string) (string, <-chan error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ServeOldstyle(l, name)
+	}()
+
+	return l.Addr().String(), served
+}
+
+// readOldstyleHeader reads the header of an oldstyle negotiation
+func readOldstyleHeader(t *testing.T, r io.Reader) nbdOldStyleHeader {
+	var osh nbdOldStyleHeader
+	require.NoError(t, binary.Read(r, binary.BigEndian, &osh))
+	require.Equal(t, uint64(NBD_MAGIC), osh.NbdMagic)
+	require.Equal(t, uint64(NBD_CLISERV_MAGIC), osh.NbdCliservMagic)
+	require.NoError(t, skip(r, 124))
+
+	return osh
+}
@@ -0,0 +1,166 @@
+package nbd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// maxErrorMessageLength is the maximum length of the message in an error chunk
+const maxErrorMessageLength = 4096
+
+// sendChunk sends a single structured reply chunk
+func (c *Connection) sendChunk(handle uint64, flags, replyType uint16, payload ...[]byte) error {
+	length := 0
+	for _, p := range payload {
+		length += len(p)
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, nbdStructuredReply{
+		NbdStructuredReplyMagic: NBD_STRUCTURED_REPLY_MAGIC,
+		NbdFlags:                flags,
+		NbdType:                 replyType,
+		NbdHandle:               handle,
+		NbdLength:               uint32(length),
+	})
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	_, err := c.plainconn.Write(buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	for _, p := range payload {
+		_, err = c.plainconn.Write(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sendErrorChunk sends a final NBD_REPLY_TYPE_ERROR chunk
+func (c *Connection) sendErrorChunk(handle uint64, nbdErr uint32, msg string) error {
+	return c.sendChunk(handle, NBD_REPLY_FLAG_DONE, NBD_REPLY_TYPE_ERROR, errorPayload(nbdErr, msg))
+}
+
+// sendErrorOffsetChunk sends a final NBD_REPLY_TYPE_ERROR_OFFSET chunk
+func (c *Connection) sendErrorOffsetChunk(handle uint64, nbdErr uint32, msg string, offset uint64) error {
+	payload := errorPayload(nbdErr, msg)
+	payload = append(payload, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(payload[len(payload)-8:], offset)
+
+	return c.sendChunk(handle, NBD_REPLY_FLAG_DONE, NBD_REPLY_TYPE_ERROR_OFFSET, payload)
+}
+
+// errorPayload returns the payload shared by all error chunks
+func errorPayload(nbdErr uint32, msg string) []byte {
+	if len(msg) > maxErrorMessageLength {
+		msg = msg[:maxErrorMessageLength]
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, nbdErr)
+	binary.Write(&buf, binary.BigEndian, uint16(len(msg)))
+	buf.WriteString(msg)
+
+	return buf.Bytes()
+}
+
+// sendReadChunks sends the data of a read request as structured reply chunks,
+// ranges that only contain zeroes are sent as holes
+// unless the client does not allow the reply to be fragmented
+func (c *Connection) sendReadChunks(req nbdRequest, data []byte) error {
+	if req.NbdCommandFlags&NBD_CMD_FLAG_DF != 0 {
+		return c.sendDataChunk(req.NbdHandle, NBD_REPLY_FLAG_DONE, req.NbdOffset, data)
+	}
+
+	segments := splitHoles(data, preferredBlockSize)
+	if len(segments) == 0 {
+		return c.sendChunk(req.NbdHandle, NBD_REPLY_FLAG_DONE, NBD_REPLY_TYPE_NONE)
+	}
+	for i, seg := range segments {
+		var flags uint16
+		if i == len(segments)-1 {
+			flags = NBD_REPLY_FLAG_DONE
+		}
+
+		offset := req.NbdOffset + uint64(seg.offset)
+		var err error
+		if seg.hole {
+			err = c.sendHoleChunk(req.NbdHandle, flags, offset, uint32(seg.length))
+		} else {
+			err = c.sendDataChunk(req.NbdHandle, flags, offset, data[seg.offset:seg.offset+seg.length])
+		}
+		if err != nil {
+			return fmt.Errorf("could not send read chunk: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// sendDataChunk sends an NBD_REPLY_TYPE_OFFSET_DATA chunk
+func (c *Connection) sendDataChunk(handle uint64, flags uint16, offset uint64, data []byte) error {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint64(header, offset)
+
+	return c.sendChunk(handle, flags, NBD_REPLY_TYPE_OFFSET_DATA, header, data)
+}
+
+// sendHoleChunk sends an NBD_REPLY_TYPE_OFFSET_HOLE chunk
+func (c *Connection) sendHoleChunk(handle uint64, flags uint16, offset uint64, length uint32) error {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint64(payload, offset)
+	binary.BigEndian.PutUint32(payload[8:], length)
+
+	return c.sendChunk(handle, flags, NBD_REPLY_TYPE_OFFSET_HOLE, payload)
+}
+
+// readSegment is a range of read data that is either all zeroes or contains data
+type readSegment struct {
+	offset int
+	length int
+	hole   bool
+}
+
+// splitHoles splits data into alternating data and hole segments,
+// data is inspected in blocks of the given size
+func splitHoles(data []byte, blockSize int) []readSegment {
+	var segments []readSegment
+	for offset := 0; offset < len(data); offset += blockSize {
+		end := offset + blockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		hole := isZero(data[offset:end])
+
+		// extend the previous segment when it is of the same kind
+		if n := len(segments); n > 0 && segments[n-1].hole == hole {
+			segments[n-1].length += end - offset
+			continue
+		}
+		segments = append(segments, readSegment{
+			offset: offset,
+			length: end - offset,
+			hole:   hole,
+		})
+	}
+
+	return segments
+}
+
+// isZero returns true when b only contains zeroes
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,117 @@
+package nbd
+
+import (
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStructuredRead(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+	data := []byte("Hello world!")
+	_, err := export.Backend.WriteAt(nil, data, 2*preferredBlockSize)
+	require.NoError(err)
+
+	server := newTestServer(t, export)
+	client, result := startNegotiation(t, server)
+	defer client.Close()
+
+	sendOpt(t, client, NBD_OPT_STRUCTURED_REPLY, nil)
+	replyType, _ := readOptReply(t, client, NBD_OPT_STRUCTURED_REPLY)
+	require.Equal(NBD_REP_ACK, replyType)
+
+	sendInfoOpt(t, client, NBD_OPT_GO, "vdisk")
+	replyType, info := readOptReply(t, client, NBD_OPT_GO)
+	require.Equal(NBD_REP_INFO, replyType)
+	require.NotZero(binary.BigEndian.Uint16(info[10:]) & NBD_FLAG_SEND_DF)
+	replyType, _ = readOptReply(t, client, NBD_OPT_GO)
+	require.Equal(NBD_REP_ACK, replyType)
+	require.NoError((<-result).err)
+
+	// read 4 blocks with data in the third one
+	sendRequest(t, client, NBD_CMD_READ, 0, 1, 0, 4*preferredBlockSize)
+
+	// first two blocks are a hole
+	chunk, payload := readChunk(t, client, 1)
+	require.Equal(uint16(NBD_REPLY_TYPE_OFFSET_HOLE), chunk.NbdType)
+	require.Equal(uint64(0), binary.BigEndian.Uint64(payload))
+	require.Equal(uint32(2*preferredBlockSize), binary.BigEndian.Uint32(payload[8:]))
+
+	chunk, payload = readChunk(t, client, 1)
+	require.Equal(uint16(NBD_REPLY_TYPE_OFFSET_DATA), chunk.NbdType)
+	require.Equal(uint64(2*preferredBlockSize), binary.BigEndian.Uint64(payload))
+	require.Len(payload[8:], preferredBlockSize)
+	require.Equal(data, payload[8:8+len(data)])
+
+	chunk, payload = readChunk(t, client, 1)
+	require.Equal(uint16(NBD_REPLY_TYPE_OFFSET_HOLE), chunk.NbdType)
+	require.Equal(uint64(3*preferredBlockSize), binary.BigEndian.Uint64(payload))
+	require.Equal(uint16(NBD_REPLY_FLAG_DONE), chunk.NbdFlags)
+
+	// a read that may not be fragmented is sent as a single chunk
+	sendRequest(t, client, NBD_CMD_READ, NBD_CMD_FLAG_DF, 2, 0, 4*preferredBlockSize)
+	chunk, payload = readChunk(t, client, 2)
+	require.Equal(uint16(NBD_REPLY_TYPE_OFFSET_DATA), chunk.NbdType)
+	require.Equal(uint16(NBD_REPLY_FLAG_DONE), chunk.NbdFlags)
+	require.Len(payload[8:], 4*preferredBlockSize)
+
+	// an invalid read is refused with an error chunk
+	sendRequest(t, client, NBD_CMD_READ, 0, 3, testExportSize, preferredBlockSize)
+	chunk, payload = readChunk(t, client, 3)
+	require.Equal(uint16(NBD_REPLY_TYPE_ERROR), chunk.NbdType)
+	require.Equal(uint16(NBD_REPLY_FLAG_DONE), chunk.NbdFlags)
+	require.Equal(uint32(NBD_EINVAL), binary.BigEndian.Uint32(payload))
+}
+
+func TestSplitHoles(t *testing.T) {
+	require := require.New(t)
+
+	data := make([]byte, 10)
+	data[4] = 1
+	data[5] = 1
+
+	require.Equal([]readSegment{
+		{offset: 0, length: 4, hole: true},
+		{offset: 4, length: 2},
+		{offset: 6, length: 4, hole: true},
+	}, splitHoles(data, 2))
+
+	require.Equal([]readSegment{
+		{offset: 0, length: 8},
+		{offset: 8, length: 2, hole: true},
+	}, splitHoles(data, 8))
+
+	require.Empty(splitHoles(nil, 2))
+}
+
+// sendRequest sends a transmission request
+func sendRequest(t *testing.T, w io.Writer, cmd, flags uint16, handle, offset uint64, length uint32) {
+	err := binary.Write(w, binary.BigEndian, nbdRequest{
+		NbdRequestMagic: NBD_REQUEST_MAGIC,
+		NbdCommandFlags: flags,
+		NbdCommandType:  cmd,
+		NbdHandle:       handle,
+		NbdOffset:       offset,
+		NbdLength:       length,
+	})
+	require.NoError(t, err)
+}
+
+// readChunk reads a structured reply chunk and returns its header and payload
+func readChunk(t *testing.T, r io.Reader, handle uint64) (nbdStructuredReply, []byte) {
+	var chunk nbdStructuredReply
+	require.NoError(t, binary.Read(r, binary.BigEndian, &chunk))
+	require.Equal(t, uint32(NBD_STRUCTURED_REPLY_MAGIC), chunk.NbdStructuredReplyMagic)
+	require.Equal(t, handle, chunk.NbdHandle)
+
+	payload := make([]byte, chunk.NbdLength)
+	_, err := io.ReadFull(r, payload)
+	require.NoError(t, err)
+
+	return chunk, payload
+}
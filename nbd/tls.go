@@ -0,0 +1,54 @@
+package nbd
+
+import (
+	"crypto/tls"
+
+	"github.com/pkg/errors"
+)
+
+// TLSMode defines whether clients can or must upgrade their connection to TLS
+type TLSMode int
+
+const (
+	// TLSDisabled refuses NBD_OPT_STARTTLS
+	TLSDisabled TLSMode = iota
+	// TLSOptional lets clients choose whether to upgrade to TLS
+	TLSOptional
+	// TLSRequired refuses all other options until the connection is upgraded to TLS
+	TLSRequired
+)
+
+// handleOptStartTLS handles NBD_OPT_STARTTLS
+// by upgrading the connection to TLS
+func (c *Connection) handleOptStartTLS(opt nbdClientOpt) error {
+	if opt.NbdOptLen != 0 {
+		return c.refuseOpt(opt, NBD_REP_ERR_INVALID, "starttls option does not take data")
+	}
+	if c.server.TLSMode == TLSDisabled || c.server.TLSConfig == nil {
+		return c.sendOptReply(opt.NbdOptID, NBD_REP_ERR_UNSUP, []byte("TLS is disabled"))
+	}
+	if c.tls {
+		return c.sendOptReply(opt.NbdOptID, NBD_REP_ERR_INVALID, []byte("TLS is already up"))
+	}
+
+	err := c.sendOptReply(opt.NbdOptID, NBD_REP_ACK, nil)
+	if err != nil {
+		return err
+	}
+
+	tlsConn := tls.Server(c.plainconn, c.server.TLSConfig)
+	err = tlsConn.Handshake()
+	if err != nil {
+		return errors.Wrap(err, "TLS handshake failed")
+	}
+	c.plainconn = tlsConn
+	c.tls = true
+	c.identify(tlsConn.ConnectionState())
+
+	// state negotiated before TLS was up can't be trusted
+	c.structuredReplies = false
+	c.baseAllocation = false
+	c.metaContextExport = ""
+
+	return nil
+}
@@ -0,0 +1,175 @@
+package nbd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartTLS_Required(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+	cert, pool := newTestCertificate(t, "localhost")
+
+	server := newTestServer(t, export)
+	server.TLSMode = TLSRequired
+	server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	client, result := startNegotiation(t, server)
+	defer client.Close()
+
+	// options are refused until TLS is up
+	sendInfoOpt(t, client, NBD_OPT_INFO, "vdisk")
+	replyType, _ := readOptReply(t, client, NBD_OPT_INFO)
+	require.Equal(NBD_REP_ERR_TLS_REQD, replyType)
+	sendOpt(t, client, NBD_OPT_LIST, nil)
+	replyType, _ = readOptReply(t, client, NBD_OPT_LIST)
+	require.Equal(NBD_REP_ERR_TLS_REQD, replyType)
+
+	tlsClient := startTLS(t, client, &tls.Config{RootCAs: pool, ServerName: "localhost"})
+
+	// TLS can only be started once
+	sendOpt(t, tlsClient, NBD_OPT_STARTTLS, nil)
+	replyType, _ = readOptReply(t, tlsClient, NBD_OPT_STARTTLS)
+	require.Equal(NBD_REP_ERR_INVALID, replyType)
+
+	sendInfoOpt(t, tlsClient, NBD_OPT_GO, "vdisk")
+	replyType, _ = readOptReply(t, tlsClient, NBD_OPT_GO)
+	require.Equal(NBD_REP_INFO, replyType)
+	replyType, _ = readOptReply(t, tlsClient, NBD_OPT_GO)
+	require.Equal(NBD_REP_ACK, replyType)
+	require.NoError((<-result).err)
+
+	// requests are handled over TLS
+	sendRequest(t, tlsClient, NBD_CMD_READ, 0, 1, 0, 4)
+	require.Equal(uint32(0), readReply(t, tlsClient, 1).NbdError)
+	readData(t, tlsClient, 4)
+
+	// the negotiation can be aborted without TLS
+	client, result = startNegotiation(t, server)
+	defer client.Close()
+	sendOpt(t, client, NBD_OPT_ABORT, nil)
+	replyType, _ = readOptReply(t, client, NBD_OPT_ABORT)
+	require.Equal(NBD_REP_ACK, replyType)
+	require.Error((<-result).err)
+}
+
+func TestStartTLS_RequiredExportName(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+	cert, _ := newTestCertificate(t, "localhost")
+
+	server := newTestServer(t, export)
+	server.TLSMode = TLSRequired
+	server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	client, result := startNegotiation(t, server)
+	defer client.Close()
+
+	// the connection is closed when an export is opened without TLS
+	sendOpt(t, client, NBD_OPT_EXPORT_NAME, []byte("vdisk"))
+	require.Error((<-result).err)
+}
+
+func TestStartTLS_Optional(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+	cert, pool := newTestCertificate(t, "localhost")
+
+	server := newTestServer(t, export)
+	server.TLSMode = TLSOptional
+	server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	client, result := startNegotiation(t, server)
+	defer client.Close()
+
+	// options are allowed before TLS is up
+	sendInfoOpt(t, client, NBD_OPT_INFO, "vdisk")
+	replyType, _ := readOptReply(t, client, NBD_OPT_INFO)
+	require.Equal(NBD_REP_INFO, replyType)
+	replyType, _ = readOptReply(t, client, NBD_OPT_INFO)
+	require.Equal(NBD_REP_ACK, replyType)
+
+	tlsClient := startTLS(t, client, &tls.Config{RootCAs: pool, ServerName: "localhost"})
+
+	sendInfoOpt(t, tlsClient, NBD_OPT_GO, "vdisk")
+	replyType, _ = readOptReply(t, tlsClient, NBD_OPT_GO)
+	require.Equal(NBD_REP_INFO, replyType)
+	replyType, _ = readOptReply(t, tlsClient, NBD_OPT_GO)
+	require.Equal(NBD_REP_ACK, replyType)
+	require.NoError((<-result).err)
+}
+
+func TestStartTLS_Disabled(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+
+	client, _ := startNegotiation(t, newTestServer(t, export))
+	defer client.Close()
+
+	sendOpt(t, client, NBD_OPT_STARTTLS, nil)
+	replyType, _ := readOptReply(t, client, NBD_OPT_STARTTLS)
+	require.Equal(NBD_REP_ERR_UNSUP, replyType)
+}
+
+// startTLS upgrades the client side of a connection to TLS
+func startTLS(t *testing.T, client net.Conn, config *tls.Config) *tls.Conn {
+	sendOpt(t, client, NBD_OPT_STARTTLS, nil)
+	replyType, _ := readOptReply(t, client, NBD_OPT_STARTTLS)
+	require.Equal(t, NBD_REP_ACK, replyType)
+
+	tlsClient := tls.Client(client, config)
+	require.NoError(t, tlsClient.Handshake())
+
+	return tlsClient
+}
+
+// newTestCertificate generates a self-signed certificate
+// that can be used by both servers and clients,
+// the returned pool can be used to verify it
+func newTestCertificate(t *testing.T, commonName string) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, pool
+}
@@ -0,0 +1,343 @@
+package nbd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/chrisvdg/nbdserver/nbd/backend"
+	"github.com/pkg/errors"
+)
+
+// defaultMaxInFlight is the number of requests of a single connection
+// that are handled concurrently when the server does not configure it
+const defaultMaxInFlight = 16
+
+// HandleRequests handles the nbd requests for a single connection
+// until the client disconnects.
+// Requests are handled concurrently and replied to as soon as they are done,
+// so replies can be sent in a different order than the requests were received.
+// ErrServerClosed is returned when the server stopped reading requests to shut down,
+// any other error when the client did not disconnect with NBD_CMD_DISC.
+func (c *Connection) HandleRequests() error {
+	defer c.release()
+
+	maxInFlight := c.server.MaxInFlight
+	if maxInFlight <= 0 {
+		maxInFlight = defaultMaxInFlight
+	}
+	inFlight := make(chan struct{}, maxInFlight)
+
+	// wait for the in-flight requests before returning
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		req, err := c.readRequest()
+		if err != nil {
+			if c.interrupted(err) {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		// don't process any further commands after a disconnect
+		cmdType := CmdTypeMap[int(req.NbdCommandType)]
+		if cmdType&CMDT_SET_DISCONNECT_RECEIVED != 0 {
+			wg.Wait()
+			c.disconnect()
+			return nil
+		}
+
+		// the payload is read even for invalid requests
+		// to stay in sync with the client
+		nbdErr, msg := c.validateRequest(req)
+		var payload []byte
+		if cmdType&CMDT_REQ_PAYLOAD != 0 {
+			if nbdErr != 0 {
+				err = skip(c.plainconn, req.NbdLength)
+			} else {
+				payload, err = c.readPayload(req)
+			}
+			if err != nil {
+				if c.interrupted(err) {
+					return ErrServerClosed
+				}
+				return err
+			}
+		}
+		if nbdErr != 0 {
+			fmt.Printf("Refusing request %d: %s\n", req.NbdCommandType, msg)
+			c.sendError(req, nbdErr, msg)
+			continue
+		}
+
+		inFlight <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-inFlight
+				wg.Done()
+			}()
+			c.handleRequest(req, payload)
+		}()
+	}
+}
+
+// readRequest reads the header of the next request
+func (c *Connection) readRequest() (nbdRequest, error) {
+	var req nbdRequest
+	err := binary.Read(c.plainconn, binary.BigEndian, &req)
+	if err != nil {
+		if cause := errors.Cause(err); cause == io.EOF || cause == io.ErrUnexpectedEOF {
+			return req, errors.New("client closed connection abruptly")
+		}
+		return req, errors.Wrap(err, "something went wrong reading a request")
+	}
+
+	if req.NbdRequestMagic != NBD_REQUEST_MAGIC {
+		return req, errors.New("client had bad magic number in request")
+	}
+
+	return req, nil
+}
+
+// interrupted returns whether reading a request failed
+// because the server interrupted the connection to shut down
+func (c *Connection) interrupted(err error) bool {
+	ne, ok := errors.Cause(err).(net.Error)
+	return ok && ne.Timeout() && c.server.shuttingDown()
+}
+
+// readPayload reads the payload of a request
+func (c *Connection) readPayload(req nbdRequest) ([]byte, error) {
+	payload := make([]byte, req.NbdLength)
+	_, err := io.ReadFull(c.plainconn, payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "something went wrong reading a request payload")
+	}
+
+	return payload, nil
+}
+
+// disconnect handles NBD_CMD_DISC,
+// the client does not expect a reply but all of its writes should be persisted
+func (c *Connection) disconnect() {
+	err := c.backend.Flush(nil)
+	if err != nil {
+		fmt.Printf("flushing the backend on disconnect failed: %s\n", err)
+	}
+}
+
+// release releases the state of the transmission phase
+func (c *Connection) release() {
+	c.export = nil
+	c.backend = nil
+	c.readOnly = false
+	c.baseAllocation = false
+	c.metaContextExport = ""
+}
+
+// handleRequest handles a single request and sends its reply
+func (c *Connection) handleRequest(req nbdRequest, payload []byte) {
+	rh := nbdReply{
+		NbdReplyMagic: NBD_REPLY_MAGIC,
+		NbdHandle:     req.NbdHandle,
+		NbdError:      0,
+	}
+
+	switch req.NbdCommandType {
+	case NBD_CMD_READ:
+		c.handleRead(req, rh)
+	case NBD_CMD_WRITE:
+		c.handleWrite(req, payload, rh)
+	case NBD_CMD_TRIM:
+		c.handleTrim(req, rh)
+	case NBD_CMD_WRITE_ZEROES:
+		c.handleWriteZeroes(req, rh)
+	case NBD_CMD_BLOCK_STATUS:
+		c.handleBlockStatus(req)
+	case NBD_CMD_FLUSH:
+		err := c.backend.Flush(nil)
+		if err != nil {
+			fmt.Printf("flushing the backend failed: %s\n", err)
+			rh.NbdError = NBD_EIO
+		}
+
+		c.sendReply(rh, nil)
+	default:
+		c.sendError(req, NBD_EINVAL, "unsupported command")
+	}
+}
+
+// sendError sends an error reply,
+// as a structured reply for commands that are replied to with structured replies
+func (c *Connection) sendError(req nbdRequest, nbdErr uint32, msg string) error {
+	if c.structuredReplies && CmdTypeMap[int(req.NbdCommandType)]&CMDT_REP_STRUCTURED != 0 {
+		return c.sendErrorChunk(req.NbdHandle, nbdErr, msg)
+	}
+
+	return c.sendReply(nbdReply{
+		NbdReplyMagic: NBD_REPLY_MAGIC,
+		NbdHandle:     req.NbdHandle,
+		NbdError:      nbdErr,
+	}, nil)
+}
+
+// sendReply sends a simple reply with optional data
+func (c *Connection) sendReply(rh nbdReply, data []byte) error {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, &rh)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	_, err := c.plainconn.Write(buf.Bytes())
+	if err != nil || len(data) == 0 {
+		return err
+	}
+	_, err = c.plainconn.Write(data)
+
+	return err
+}
+
+// handleRead handles NBD_CMD_READ,
+// the data is sent in structured reply chunks when the client negotiated those
+func (c *Connection) handleRead(req nbdRequest, rh nbdReply) {
+	// read from backend
+	data, err := c.backend.ReadAt(nil, int64(req.NbdOffset), int64(req.NbdLength))
+	if err != nil {
+		fmt.Printf("Something went wrong reading from backend: %v\n", err)
+	}
+
+	if c.structuredReplies {
+		if err != nil {
+			c.sendErrorOffsetChunk(req.NbdHandle, NBD_EIO, err.Error(), req.NbdOffset)
+			return
+		}
+		c.sendReadChunks(req, data)
+		return
+	}
+
+	// send data if no error occurred
+	if err != nil {
+		rh.NbdError = NBD_EIO
+		data = nil
+	}
+	c.sendReply(rh, data)
+}
+
+// handleWrite handles NBD_CMD_WRITE,
+// the data is only forced to stable storage when the client asked for it
+func (c *Connection) handleWrite(req nbdRequest, buf []byte, rh nbdReply) {
+	var err error
+	fuaWriter, ok := c.backend.(backend.FUAWriter)
+	if ok && req.NbdCommandFlags&NBD_CMD_FLAG_FUA != 0 {
+		_, err = fuaWriter.WriteAtFUA(nil, buf, int64(req.NbdOffset))
+	} else {
+		_, err = c.backend.WriteAt(nil, buf, int64(req.NbdOffset))
+		if err == nil {
+			err = c.fua(req)
+		}
+	}
+	if err != nil {
+		fmt.Printf("Something went wrong writing to the backend: %v\n", err)
+		rh.NbdError = NBD_EIO
+		if err == backend.ErrNoSpace {
+			rh.NbdError = NBD_ENOSPC
+		}
+	}
+
+	c.sendReply(rh, nil)
+}
+
+// fua flushes the backend when the request has the FUA flag set
+func (c *Connection) fua(req nbdRequest) error {
+	if req.NbdCommandFlags&NBD_CMD_FLAG_FUA == 0 {
+		return nil
+	}
+
+	return c.backend.Flush(nil)
+}
+
+// handleTrim handles NBD_CMD_TRIM,
+// the range is left as is when the backend can't deallocate it
+func (c *Connection) handleTrim(req nbdRequest, rh nbdReply) {
+	trimmer, ok := c.backend.(backend.Trimmer)
+	if !ok {
+		rh.NbdError = NBD_EINVAL
+		c.sendReply(rh, nil)
+		return
+	}
+
+	err := trimmer.Trim(nil, int64(req.NbdOffset), int64(req.NbdLength))
+	// trimming is advisory, so backends that can't deallocate the range ignore it
+	if errors.Cause(err) == backend.ErrZeroNotSupported {
+		err = nil
+	}
+	if err == nil {
+		err = c.fua(req)
+	}
+	if err != nil {
+		fmt.Printf("Something went wrong trimming the backend: %v\n", err)
+		rh.NbdError = NBD_EIO
+	}
+
+	c.sendReply(rh, nil)
+}
+
+// handleWriteZeroes handles NBD_CMD_WRITE_ZEROES,
+// zeroes are written to the backend when it can't zero the range itself,
+// unless the client asked for a fast zero
+func (c *Connection) handleWriteZeroes(req nbdRequest, rh nbdReply) {
+	offset, length := int64(req.NbdOffset), int64(req.NbdLength)
+	noHole := req.NbdCommandFlags&NBD_CMD_FLAG_NO_HOLE != 0
+
+	var err error
+	zeroer, ok := c.backend.(backend.WriteZeroer)
+	if ok {
+		err = zeroer.WriteZeroes(nil, offset, length, noHole)
+	}
+	// other errors of the backend are returned to the client
+	if !ok || errors.Cause(err) == backend.ErrZeroNotSupported {
+		if req.NbdCommandFlags&NBD_CMD_FLAG_FAST_ZERO != 0 {
+			rh.NbdError = NBD_ENOTSUP
+			c.sendReply(rh, nil)
+			return
+		}
+		err = writeZeroes(c.backend, offset, length)
+	}
+	if err == nil {
+		err = c.fua(req)
+	}
+	if err != nil {
+		fmt.Printf("Something went wrong writing zeroes to the backend: %v\n", err)
+		rh.NbdError = NBD_EIO
+	}
+
+	c.sendReply(rh, nil)
+}
+
+// writeZeroes zeroes a range of a backend by writing zeroes to it
+func writeZeroes(b backend.Backend, offset, length int64) error {
+	zeroes := make([]byte, preferredBlockSize*256)
+	for length > 0 {
+		n := int64(len(zeroes))
+		if n > length {
+			n = length
+		}
+
+		_, err := b.WriteAt(nil, zeroes[:n], offset)
+		if err != nil {
+			return err
+		}
+
+		offset += n
+		length -= n
+	}
+
+	return nil
+}
@@ -0,0 +1,152 @@
+package nbd
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/chrisvdg/nbdserver/nbd/backend"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleRequests_OutOfOrder(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+	blocking := &blockingBackend{
+		Backend: export.Backend,
+		unblock: make(chan struct{}),
+	}
+	export.Backend = blocking
+
+	client, result := startNegotiation(t, newTestServer(t, export))
+	defer client.Close()
+
+	sendInfoOpt(t, client, NBD_OPT_GO, "vdisk")
+	readOptReply(t, client, NBD_OPT_GO)
+	replyType, _ := readOptReply(t, client, NBD_OPT_GO)
+	require.Equal(NBD_REP_ACK, replyType)
+	require.NoError((<-result).err)
+
+	// the first read blocks until the second one was replied to
+	sendRequest(t, client, NBD_CMD_READ, 0, 1, 0, preferredBlockSize)
+	sendRequest(t, client, NBD_CMD_READ, 0, 2, preferredBlockSize, preferredBlockSize)
+
+	readReply(t, client, 2)
+	readData(t, client, preferredBlockSize)
+	close(blocking.unblock)
+	readReply(t, client, 1)
+	readData(t, client, preferredBlockSize)
+
+	// in-flight requests are finished before disconnecting
+	sendRequest(t, client, NBD_CMD_WRITE, 0, 3, 0, 4)
+	_, err := client.Write([]byte("data"))
+	require.NoError(err)
+	readReply(t, client, 3)
+	sendRequest(t, client, NBD_CMD_DISC, 0, 4, 0, 0)
+	res := <-result
+	require.True(res.handled)
+	require.NoError(res.err)
+}
+
+func TestHandleRequests_MaxInFlight(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+	blocking := &blockingBackend{
+		Backend: export.Backend,
+		unblock: make(chan struct{}),
+		blocked: make(chan struct{}, 1),
+	}
+	export.Backend = blocking
+	server := newTestServer(t, export)
+	server.MaxInFlight = 1
+
+	client, result := startNegotiation(t, server)
+	defer client.Close()
+
+	sendInfoOpt(t, client, NBD_OPT_GO, "vdisk")
+	readOptReply(t, client, NBD_OPT_GO)
+	replyType, _ := readOptReply(t, client, NBD_OPT_GO)
+	require.Equal(NBD_REP_ACK, replyType)
+	require.NoError((<-result).err)
+
+	// the second read isn't handled while the first one blocks
+	sendRequest(t, client, NBD_CMD_READ, 0, 1, 0, preferredBlockSize)
+	sendRequest(t, client, NBD_CMD_READ, 0, 2, preferredBlockSize, preferredBlockSize)
+	<-blocking.blocked
+
+	require.NoError(client.SetReadDeadline(time.Now().Add(100 * time.Millisecond)))
+	_, err := client.Read(make([]byte, 1))
+	require.Error(err)
+	ne, ok := err.(net.Error)
+	require.True(ok)
+	require.True(ne.Timeout(), "no reply should be sent before the first read completes")
+	require.NoError(client.SetReadDeadline(time.Time{}))
+
+	// so the replies are in order
+	close(blocking.unblock)
+	readReply(t, client, 1)
+	readData(t, client, preferredBlockSize)
+	readReply(t, client, 2)
+	readData(t, client, preferredBlockSize)
+}
+
+// blockingBackend blocks reads at offset 0 until unblocked
+type blockingBackend struct {
+	backend.Backend
+	unblock chan struct{}
+	// receives a value when a read blocks, if set
+	blocked chan struct{}
+}
+
+func (b *blockingBackend) ReadAt(ctx context.Context, offset, length int64) ([]byte, error) {
+	if offset == 0 {
+		if b.blocked != nil {
+			b.blocked <- struct{}{}
+		}
+		<-b.unblock
+	}
+	return b.Backend.ReadAt(ctx, offset, length)
+}
+
+// readData reads the data of a simple reply
+func readData(t *testing.T, r io.Reader, n int) []byte {
+	data := make([]byte, n)
+	_, err := io.ReadFull(r, data)
+	require.NoError(t, err)
+
+	return data
+}
+
+func TestHandleRequests_NoSpace(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+	export.Backend.(*backend.Memory).MaxMemory = preferredBlockSize
+
+	client, result := startNegotiation(t, newTestServer(t, export))
+	defer client.Close()
+
+	sendInfoOpt(t, client, NBD_OPT_GO, "vdisk")
+	readOptReply(t, client, NBD_OPT_GO)
+	replyType, _ := readOptReply(t, client, NBD_OPT_GO)
+	require.Equal(NBD_REP_ACK, replyType)
+	require.NoError((<-result).err)
+
+	// writes that don't fit in the memory of the backend fail with ENOSPC
+	sendRequest(t, client, NBD_CMD_WRITE, 0, 1, 0, 4)
+	_, err := client.Write([]byte("data"))
+	require.NoError(err)
+	require.Equal(uint32(0), readReply(t, client, 1).NbdError)
+
+	sendRequest(t, client, NBD_CMD_WRITE, 0, 2, testExportSize/2, 4)
+	_, err = client.Write([]byte("data"))
+	require.NoError(err)
+	require.Equal(uint32(NBD_ENOSPC), readReply(t, client, 2).NbdError)
+}
@@ -0,0 +1,44 @@
+package nbd
+
+// validateRequest applies the checks of CmdTypeMap to a request,
+// it returns the NBD error and a message when the request is invalid
+func (c *Connection) validateRequest(req nbdRequest) (uint32, string) {
+	cmdType, ok := CmdTypeMap[int(req.NbdCommandType)]
+	if !ok {
+		return NBD_EINVAL, "unsupported command"
+	}
+
+	if cmdType&CMDT_CHECK_NOT_READ_ONLY != 0 && c.readOnly {
+		return NBD_EPERM, "export is read-only"
+	}
+
+	// fast zeroes may only be requested when they were advertised
+	if req.NbdCommandFlags&NBD_CMD_FLAG_FAST_ZERO != 0 &&
+		c.transmissionFlags(c.export)&NBD_FLAG_SEND_FAST_ZERO == 0 {
+		return NBD_EINVAL, "fast zeroes were not negotiated"
+	}
+
+	if cmdType&CMDT_CHECK_LENGTH_OFFSET != 0 {
+		if req.NbdLength == 0 {
+			return NBD_EINVAL, "request has no length"
+		}
+
+		size := c.backend.Size()
+		if req.NbdOffset > size || uint64(req.NbdLength) > size-req.NbdOffset {
+			// writes past the end of the export are out of space
+			if cmdType&(CMDT_REQ_PAYLOAD|CMDT_REQ_FAKE_PAYLOAD) != 0 {
+				return NBD_ENOSPC, "request exceeds the size of the export"
+			}
+			return NBD_EINVAL, "request exceeds the size of the export"
+		}
+	}
+
+	if cmdType&(CMDT_REQ_PAYLOAD|CMDT_REP_PAYLOAD) != 0 && req.NbdLength > maximumBlockSize {
+		if cmdType&CMDT_REP_PAYLOAD != 0 {
+			return NBD_EOVERFLOW, "request exceeds the maximum payload size"
+		}
+		return NBD_EINVAL, "request exceeds the maximum payload size"
+	}
+
+	return 0, ""
+}
@@ -0,0 +1,70 @@
+package nbd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateRequest(t *testing.T) {
+	require := require.New(t)
+
+	export, cleanup := newTestExport(t, "vdisk")
+	defer cleanup()
+	readOnly := &Export{Name: "readonly", Backend: export.Backend, ReadOnly: true}
+
+	client, result := startNegotiation(t, newTestServer(t, export, readOnly))
+	defer client.Close()
+
+	sendInfoOpt(t, client, NBD_OPT_GO, "vdisk")
+	readOptReply(t, client, NBD_OPT_GO)
+	replyType, _ := readOptReply(t, client, NBD_OPT_GO)
+	require.Equal(NBD_REP_ACK, replyType)
+	require.NoError((<-result).err)
+
+	// the payload of an invalid write is skipped
+	data := []byte("Hello world!")
+	sendRequest(t, client, NBD_CMD_WRITE, 0, 1, testExportSize-4, uint32(len(data)))
+	_, err := client.Write(data)
+	require.NoError(err)
+	require.Equal(uint32(NBD_ENOSPC), readReply(t, client, 1).NbdError)
+
+	sendRequest(t, client, NBD_CMD_READ, 0, 2, testExportSize, 1)
+	require.Equal(uint32(NBD_EINVAL), readReply(t, client, 2).NbdError)
+
+	sendRequest(t, client, NBD_CMD_READ, 0, 3, 0, 0)
+	require.Equal(uint32(NBD_EINVAL), readReply(t, client, 3).NbdError)
+
+	sendRequest(t, client, NBD_CMD_READ, 0, 4, 1<<63, 1)
+	require.Equal(uint32(NBD_EINVAL), readReply(t, client, 4).NbdError)
+
+	sendRequest(t, client, 99, 0, 5, 0, 0)
+	require.Equal(uint32(NBD_EINVAL), readReply(t, client, 5).NbdError)
+
+	// valid requests are still handled
+	sendRequest(t, client, NBD_CMD_READ, 0, 6, 0, 4)
+	require.Equal(uint32(0), readReply(t, client, 6).NbdError)
+	readData(t, client, 4)
+
+	// read-only exports refuse writes
+	client, result = startNegotiation(t, newTestServer(t, readOnly))
+	defer client.Close()
+
+	sendInfoOpt(t, client, NBD_OPT_GO, "readonly")
+	readOptReply(t, client, NBD_OPT_GO)
+	replyType, _ = readOptReply(t, client, NBD_OPT_GO)
+	require.Equal(NBD_REP_ACK, replyType)
+	require.NoError((<-result).err)
+
+	sendRequest(t, client, NBD_CMD_WRITE, 0, 1, 0, uint32(len(data)))
+	_, err = client.Write(data)
+	require.NoError(err)
+	require.Equal(uint32(NBD_EPERM), readReply(t, client, 1).NbdError)
+
+	sendRequest(t, client, NBD_CMD_TRIM, 0, 2, 0, 4)
+	require.Equal(uint32(NBD_EPERM), readReply(t, client, 2).NbdError)
+
+	sendRequest(t, client, NBD_CMD_READ, 0, 3, 0, 4)
+	require.Equal(uint32(0), readReply(t, client, 3).NbdError)
+	readData(t, client, 4)
+}